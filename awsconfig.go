@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// AWSConfigKeyPrefix marks awsssologin's own keys in ~/.aws/config. The AWS
+// CLI ignores keys it doesn't know, so they can sit in [sso-session] sections
+// next to the settings they belong to.
+const AWSConfigKeyPrefix = "awsssologin_"
+
+var awsSSOSessionHeader = regexp.MustCompile(`^\[\s*sso-session\s+(.+?)\s*\]$`)
+
+// awsSSOSession is one [sso-session] section of ~/.aws/config with its
+// awsssologin_* keys parsed.
+type awsSSOSession struct {
+	Name     string
+	StartURL string
+	Identity string   // awsssologin_identity
+	Settings identity // the other awsssologin_* keys
+}
+
+// awsConfigPath returns $AWS_CONFIG_FILE or ~/.aws/config, as the AWS CLI does.
+func awsConfigPath() (string, error) {
+	if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+		return expandHome(path), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "config"), nil
+}
+
+// loadAWSConfig reads the [sso-session] sections of the AWS config file. A
+// missing file is fine.
+func (c *Config) loadAWSConfig() error {
+	path, err := awsConfigPath()
+	if err != nil {
+		log.Debug("Could not locate the AWS config file", "error", err)
+		return nil
+	}
+
+	sessions, err := readAWSSSOSessions(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Debug("No AWS config file", "path", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("AWS config %s: %v", path, err)
+	}
+	c.awsSessions = sessions
+	return nil
+}
+
+// readAWSSSOSessions parses the [sso-session] sections of an AWS config file.
+// Only sso_start_url and awsssologin_* keys are kept; nested sub-section
+// values (indented lines) and other sections are skipped.
+func readAWSSSOSessions(path string) ([]awsSSOSession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		sessions []awsSSOSession
+		current  *awsSSOSession
+	)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			current = nil
+			if m := awsSSOSessionHeader.FindStringSubmatch(line); m != nil {
+				sessions = append(sessions, awsSSOSession{Name: m[1]})
+				current = &sessions[len(sessions)-1]
+			}
+			continue
+		}
+		if current == nil || raw[0] == ' ' || raw[0] == '\t' {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "sso_start_url" {
+			current.StartURL = value
+			continue
+		}
+		if err := current.set(key, value); err != nil {
+			return nil, fmt.Errorf("line %d: sso-session %s: %v", lineNo, current.Name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range sessions {
+		if err := s.Settings.validate(); err != nil {
+			return nil, fmt.Errorf("sso-session %s: %v", s.Name, err)
+		}
+	}
+	return sessions, nil
+}
+
+// set applies one awsssologin_* key. Other keys belong to the AWS CLI and are
+// ignored; unknown awsssologin_* keys are warned about, not fatal, so an
+// older binary still works with a newer config.
+func (s *awsSSOSession) set(key, value string) error {
+	name, ok := strings.CutPrefix(key, AWSConfigKeyPrefix)
+	if !ok {
+		return nil
+	}
+
+	var err error
+	switch name {
+	case "identity":
+		s.Identity = value
+	case "username":
+		s.Settings.Username = value
+	case "2fa_cmd":
+		s.Settings.TwoFACmd = value
+	case "timeout":
+		s.Settings.Timeout, err = strconv.Atoi(value)
+	case "deadline":
+		s.Settings.Deadline, err = strconv.Atoi(value)
+	case "show_browser":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		s.Settings.ShowBrowser = &b
+	case "persist_session":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		s.Settings.PersistSession = &b
+	case "browser_bin":
+		s.Settings.BrowserBin = value
+	case "offline":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		s.Settings.Offline = &b
+	case "block_requests":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		s.Settings.BlockRequests = &b
+	case "relay_callback":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		s.Settings.RelayCallback = &b
+	case "proxy":
+		s.Settings.Proxy = value
+	case "proxy_pac":
+		s.Settings.ProxyPAC = value
+	case "proxy_user":
+		s.Settings.ProxyUser = value
+	case "ca_file":
+		s.Settings.CAFile = value
+	case "debug_dir":
+		s.Settings.DebugDir = value
+	case "log_level":
+		s.Settings.LogLevel = value
+	case "totp_digits":
+		s.Settings.TOTP.Digits, err = strconv.Atoi(value)
+	case "totp_period":
+		var period uint64
+		period, err = strconv.ParseUint(value, 10, 32)
+		s.Settings.TOTP.Period = uint(period)
+	case "totp_algorithm":
+		s.Settings.TOTP.Algorithm = value
+	default:
+		log.Warn("Ignoring unknown key in AWS config", "ssoSession", s.Name, "key", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return nil
+}
+
+// matchAWSSSOSession finds the sso-session for this login: the named one if
+// --sso-session was given, else the single one whose sso_start_url host is
+// the login URL's host. Several sessions sharing a start URL can't be told
+// apart, so that case matches nothing (with a warning).
+func matchAWSSSOSession(sessions []awsSSOSession, name, loginURL string) *awsSSOSession {
+	if name != "" {
+		for i := range sessions {
+			if sessions[i].Name == name {
+				return &sessions[i]
+			}
+		}
+		return nil
+	}
+
+	host := urlHost(loginURL)
+	if host == "" {
+		return nil
+	}
+	var found []int
+	for i, s := range sessions {
+		if s.StartURL != "" && strings.EqualFold(urlHost(s.StartURL), host) {
+			found = append(found, i)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil
+	case 1:
+		return &sessions[found[0]]
+	default:
+		names := make([]string, len(found))
+		for i, idx := range found {
+			names[i] = sessions[idx].Name
+		}
+		log.Warn("Several AWS sso-sessions share this start URL; pass --sso-session to pick one", "ssoSessions", strings.Join(names, ", "))
+		return nil
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// BatchChildWait bounds waiting for an --exec child to exit once its login is
+// approved. The AWS CLI polls for its token every few seconds.
+const BatchChildWait = 60 * time.Second
+
+// batchItem is one login of a batch run and, once run, its result.
+type batchItem struct {
+	Source string // where the URL came from: --url, file:line, --exec #n
+	URL    string
+	Flow   string // "device" or "dex"
+	Err    error
+	Took   time.Duration
+
+	child *batchChild // the command printing the URL, for --exec
+	// skipped is set when a concurrent login of the item's session left a
+	// valid SSO token, so there was nothing to approve.
+	skipped bool
+	// rejected is set when the login's credentials or MFA code were rejected.
+	rejected bool
+}
+
+// batchChild is an --exec command. Its output is forwarded to stderr and
+// scanned for the first login URL.
+type batchChild struct {
+	cmd  *exec.Cmd
+	urls chan string // the URL, or closed if the output ended without one
+	done chan error  // the exit status
+}
+
+// newBatchCmd builds the `batch` command. It takes the login flags; the URLs
+// come from its own --url, --urls-file and --exec flags.
+func newBatchCmd(config *Config) *cobra.Command {
+	var (
+		urls     []string
+		urlsFile string
+		execs    []string
+	)
+
+	batchCmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Approve several device-code and Dex logins in one browser run",
+		Long: `Approve several device-code and Dex logins in one browser run.
+
+The URLs are opened one after another as tabs of a single browser. The first
+login signs in; the rest reuse the portal session and only need approving. A
+failed URL doesn't stop the others, and a summary lists every result.
+
+URLs come from --url (repeatable), --urls-file (one per line, '-' for stdin),
+and --exec (repeatable): a command such as 'aws sso login --no-browser
+--use-device-code' whose output is scanned for its URL. Each command is then
+left to finish its own login.`,
+		Example: `  awsssologin batch \
+    --exec 'aws sso login --sso-session dev --no-browser --use-device-code' \
+    --exec 'aws sso login --sso-session prod --no-browser --use-device-code' \
+    --exec 'argocd login --grpc-web argocd.example.com --sso --sso-launch-browser=false'`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.prepareSubcommand(cmd); err != nil {
+				return err
+			}
+			defer config.wipeSecrets()
+			if err := config.checkOffline(); err != nil {
+				return err
+			}
+
+			if config.DeviceURL != "" || config.DexURL != "" {
+				return fmt.Errorf("batch takes its URLs from --url, --urls-file and --exec, not --device-url, --oidc-url or --dex-url")
+			}
+			if config.OOB || config.OOBExec != "" {
+				return fmt.Errorf("batch doesn't support out-of-band logins; run awsssologin --oob or --oob-exec for each")
+			}
+			if urlsFile == StdinURLSource && config.PromptBackend == PromptBackendStdin {
+				return fmt.Errorf("--prompt-backend stdin can't be used with --urls-file -")
+			}
+
+			// The --exec commands run under the deadline too, and are killed
+			// with it.
+			ctx, cancel := config.withDeadline(cmd.Context())
+			defer cancel()
+			items, err := collectBatchItems(ctx, urls, urlsFile, execs)
+			if err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return fmt.Errorf("no URLs: pass --url, --urls-file or --exec")
+			}
+			return runBatch(ctx, config, items)
+		},
+	}
+
+	batchCmd.Flags().StringArrayVar(&urls, "url", nil, "Device or Dex URL to approve (repeatable)")
+	batchCmd.Flags().StringVar(&urlsFile, "urls-file", "", "File with one URL per line ('-' for stdin); blank lines and # comments are ignored")
+	batchCmd.Flags().StringArrayVar(&execs, "exec", nil, "Command whose output carries a URL to approve, e.g. 'aws sso login --no-browser --use-device-code' (repeatable)")
+
+	return batchCmd
+}
+
+// collectBatchItems lists the logins in flag order: --url, then --urls-file,
+// then --exec. The --exec commands are started here, so they print their URLs
+// while the others are checked; they are killed once ctx is done.
+func collectBatchItems(ctx context.Context, urls []string, urlsFile string, execs []string) ([]*batchItem, error) {
+	var items []*batchItem
+	for _, u := range urls {
+		items = append(items, &batchItem{Source: "--url", URL: u})
+	}
+
+	if urlsFile != "" {
+		fileItems, err := readURLsFile(urlsFile)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, fileItems...)
+	}
+
+	for i, line := range execs {
+		item := &batchItem{Source: fmt.Sprintf("--exec #%d", i+1)}
+		item.child, item.Err = startBatchChild(ctx, line, i+1)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// readURLsFile reads one URL per line from path, or stdin for "-".
+func readURLsFile(path string) ([]*batchItem, error) {
+	var r io.Reader = os.Stdin
+	name := "stdin"
+	if path != StdinURLSource {
+		f, err := os.Open(expandHome(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open URLs file: %v", err)
+		}
+		defer f.Close()
+		r, name = f, path
+	}
+
+	var items []*batchItem
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items = append(items, &batchItem{Source: fmt.Sprintf("%s:%d", name, n), URL: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read URLs file: %v", err)
+	}
+	return items, nil
+}
+
+// startBatchChild starts an --exec command. Its output lines are forwarded to
+// stderr prefixed with [n]. The command is killed once ctx is done.
+func startBatchChild(ctx context.Context, line string, n int) (*batchChild, error) {
+	cmd := shellCommand(ctx, line)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return nil, fmt.Errorf("failed to start %q: %v", line, err)
+	}
+	w.Close()
+	log.Info("Started command", "n", n, "command", line)
+
+	c := &batchChild{cmd: cmd, urls: make(chan string, 1), done: make(chan error, 1)}
+	// Waited for apart from the output: a grandchild may hold the pipe open
+	// after the command itself has exited or been killed.
+	go func() { c.done <- cmd.Wait() }()
+	go func() {
+		defer r.Close()
+		found := false
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			text := scanner.Text()
+			fmt.Fprintf(os.Stderr, "[%d] %s\n", n, text)
+			if !found {
+				if u := findLoginURL(text); u != "" {
+					found = true
+					c.urls <- u
+				}
+			}
+		}
+		close(c.urls)
+	}()
+	return c, nil
+}
+
+// waitURL waits up to timeout for the command's login URL.
+func (c *batchChild) waitURL(ctx context.Context, timeout time.Duration) (string, error) {
+	select {
+	case u, ok := <-c.urls:
+		if !ok {
+			return "", fmt.Errorf("command output ended without a login URL")
+		}
+		return u, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timed out after %s waiting for the command to print a login URL", timeout)
+	case <-ctx.Done():
+		return "", fmt.Errorf("stopped waiting for the command's login URL: %v", context.Cause(ctx))
+	}
+}
+
+// finish lets the command complete its login, or kills it if the login
+// failed. It returns why the command failed, if it did.
+func (c *batchChild) finish(approved bool) error {
+	if !approved {
+		_ = c.cmd.Process.Kill()
+		<-c.done
+		return nil
+	}
+	select {
+	case err := <-c.done:
+		if err != nil {
+			return fmt.Errorf("command failed after approval: %v", err)
+		}
+		return nil
+	case <-time.After(BatchChildWait):
+		_ = c.cmd.Process.Kill()
+		<-c.done
+		return fmt.Errorf("command still running %s after approval; killed", BatchChildWait)
+	}
+}
+
+// findLoginURL returns the first device or Dex URL on a line of CLI output.
+func findLoginURL(line string) string {
+	if u := deviceURLPattern.FindString(line); u != "" {
+		return u
+	}
+	return dexURLPattern.FindString(line)
+}
+
+// loginFlow tells a device URL from an OIDC (Dex or other) auth URL.
+func loginFlow(rawURL string) (string, error) {
+	if validateDeviceURL(rawURL) == nil {
+		return "device", nil
+	}
+	if err := validateDexURL(rawURL); err != nil {
+		return "", fmt.Errorf("neither an AWS SSO device URL nor an OIDC auth URL: %v", err)
+	}
+	return "dex", nil
+}
+
+// forURL returns a copy of the configuration set up for one login of a batch.
+func (c *Config) forURL(flow, loginURL string) *Config {
+	item := *c
+	item.DeviceURL, item.DexURL = "", ""
+	if flow == "dex" {
+		item.DexURL = loginURL
+	} else {
+		item.DeviceURL = loginURL
+	}
+	return &item
+}
+
+// runBatch resolves every item's URL, then runs the logins in order in one
+// browser. Settings and credentials are picked once, by the first URL.
+func runBatch(ctx context.Context, config *Config, items []*batchItem) error {
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+
+	var first *batchItem
+	for _, item := range items {
+		if item.Err == nil && item.child != nil {
+			item.URL, item.Err = item.child.waitURL(ctx, timeout)
+		}
+		if item.Err == nil {
+			item.Flow, item.Err = loginFlow(item.URL)
+		}
+		// The code of an out-of-band login would have nowhere to go.
+		if item.Err == nil && config.forURL(item.Flow, item.URL).outOfBand() {
+			item.Err = fmt.Errorf("out-of-band logins aren't supported by batch; run awsssologin --oob for this URL")
+		}
+		if item.Err == nil && first == nil {
+			first = item
+		}
+	}
+
+	if first != nil {
+		if err := runBatchLogins(ctx, config, items, first); err != nil {
+			for _, item := range items {
+				if item.Err == nil {
+					item.Err = err
+				}
+			}
+		}
+	}
+
+	for _, item := range items {
+		if item.child != nil {
+			if err := item.child.finish(item.Err == nil && !item.skipped); err != nil {
+				item.Err = err
+			}
+		}
+	}
+
+	printBatchSummary(os.Stdout, items)
+
+	failed := 0
+	for _, item := range items {
+		if item.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d logins failed", failed, len(items))
+	}
+	log.Info("All logins completed successfully!", "count", len(items))
+	return nil
+}
+
+// runBatchLogins signs in and approves every item that has a URL. An error
+// is returned only if no login could be attempted at all.
+func runBatchLogins(ctx context.Context, config *Config, items []*batchItem, first *batchItem) (err error) {
+	if err := config.applyURLSettings(first.URL); err != nil {
+		return fmt.Errorf("failed to select settings: %v", err)
+	}
+
+	// One login per session at a time, as for a single login: the browser
+	// starts once the batch holds the lock of every session it logs in to.
+	locks, err := lockBatchSessions(ctx, config, items)
+	if err != nil {
+		return fmt.Errorf("failed to lock session: %v", err)
+	}
+	defer func() {
+		for _, l := range locks {
+			l.release(err)
+		}
+	}()
+
+	pending := 0
+	for _, item := range items {
+		if item.Err == nil && !item.skipped {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+	if err := getCredentials(ctx, config); err != nil {
+		return fmt.Errorf("failed to get credentials: %v", err)
+	}
+
+	log.Info("Starting browser automation...", "logins", pending)
+	session, err := launchBrowser(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	failed, approved := false, false
+	for i, item := range items {
+		if item.Err != nil || item.skipped {
+			continue
+		}
+		if ctx.Err() != nil {
+			item.Err = fmt.Errorf("not attempted: %v", context.Cause(ctx))
+			failed = true
+			continue
+		}
+		log.Info("Approving login", "n", i+1, "of", len(items), "flow", item.Flow, "source", item.Source)
+		start := time.Now()
+		itemConfig := config.forURL(item.Flow, item.URL)
+		item.Err = session.login(ctx, item.URL, itemConfig)
+		item.Took = time.Since(start)
+
+		// Credentials prompted for during this login serve the next ones too.
+		config.Username, config.Password = itemConfig.Username, itemConfig.Password
+		item.rejected = itemConfig.rejected
+
+		if item.Err != nil {
+			failed = true
+			log.Error("Login failed", "n", i+1, "error", item.Err)
+		} else {
+			approved = true
+		}
+	}
+
+	if approved {
+		session.saveProfile()
+	}
+	if failed {
+		session.linger(ctx)
+	}
+	session.close()
+	return nil
+}
+
+// batchLock is a session lock held by a batch, and the items logging in to
+// that session.
+type batchLock struct {
+	lock  *sessionLock
+	items []*batchItem
+}
+
+// lockBatchSessions takes the session lock of every item with a URL, in key
+// order so that concurrent batches can't deadlock. An item whose session was
+// logged in to by a concurrent login meanwhile is failed or skipped as
+// afterConcurrentLogin decides.
+func lockBatchSessions(ctx context.Context, config *Config, items []*batchItem) ([]*batchLock, error) {
+	sessions := map[string][]*batchItem{}
+	for _, item := range items {
+		if item.Err == nil {
+			key := config.forURL(item.Flow, item.URL).sessionLockKey(item.URL)
+			sessions[key] = append(sessions[key], item)
+		}
+	}
+	keys := make([]string, 0, len(sessions))
+	for key := range sessions {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var locks []*batchLock
+	for _, key := range keys {
+		sessionItems := sessions[key]
+		first := sessionItems[0]
+		lock, previous, err := acquireSessionLock(ctx, config.forURL(first.Flow, first.URL), first.URL)
+		if err != nil {
+			for _, l := range locks {
+				l.release(err)
+			}
+			return nil, err
+		}
+		locks = append(locks, &batchLock{lock: lock, items: sessionItems})
+		if previous == nil {
+			continue
+		}
+		for _, item := range sessionItems {
+			if done, err := afterConcurrentLogin(previous, config.forURL(item.Flow, item.URL), item.URL); done {
+				item.Err, item.skipped = err, err == nil
+			}
+		}
+	}
+	return locks, nil
+}
+
+// release records how the session's logins went, the first failure if any
+// and whether any had its credentials rejected, and unlocks. batchErr fails
+// them all.
+func (l *batchLock) release(batchErr error) {
+	err, rejected := batchErr, false
+	for _, item := range l.items {
+		if err == nil {
+			err = item.Err
+		}
+		rejected = rejected || item.rejected
+	}
+	l.lock.release(err, rejected)
+}
+
+// printBatchSummary writes one line per login.
+func printBatchSummary(out io.Writer, items []*batchItem) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSOURCE\tFLOW\tRESULT\tTIME\tDETAIL")
+	for i, item := range items {
+		flow, result, detail := item.Flow, "ok", item.URL
+		if flow == "" {
+			flow = "-"
+		}
+		if item.Err != nil {
+			result, detail = "failed", item.Err.Error()
+		} else if item.skipped {
+			result, detail = "skipped", "a concurrent login left a valid SSO token"
+		}
+		took := "-"
+		if item.Took > 0 {
+			took = item.Took.Round(100 * time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i+1, item.Source, flow, result, took, detail)
+	}
+	w.Flush()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testDeviceURL = "https://corp.awsapps.com/start/#/device?user_code=ABCD-EFGH"
+	testDexURL    = "https://argocd.example.com/api/dex/auth?client_id=argo-cd-cli&redirect_uri=http%3A%2F%2Flocalhost%3A8085%2Fauth%2Fcallback"
+)
+
+// TestBatchItems checks URL collection from a file, flow detection, and that
+// an --exec command's URL is found in its output.
+func TestBatchItems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	if err := os.WriteFile(path, []byte("# morning logins\n"+testDeviceURL+"\n\n  "+testDexURL+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	items, err := collectBatchItems(t.Context(), []string{"https://example.com/"}, path, nil)
+	if err != nil {
+		t.Fatalf("collectBatchItems: %v", err)
+	}
+	if len(items) != 3 || items[1].Source != path+":2" || items[2].URL != testDexURL {
+		t.Fatalf("items = %+v", items)
+	}
+
+	for _, tt := range []struct {
+		url, flow string
+	}{
+		{testDeviceURL, "device"},
+		{testDexURL, "dex"},
+		{"https://example.com/", ""},
+	} {
+		flow, err := loginFlow(tt.url)
+		if flow != tt.flow || (tt.flow == "") != (err != nil) {
+			t.Errorf("loginFlow(%q) = %q, %v; want %q", tt.url, flow, err, tt.flow)
+		}
+	}
+
+	// An out-of-band URL fails before any browser is started.
+	oob := &batchItem{Source: "--url", URL: "https://dex.example.com/auth?client_id=kubelogin&redirect_uri=" + RedirectURIOOB}
+	if err := runBatch(t.Context(), &Config{TimeoutSeconds: 1}, []*batchItem{oob}); err == nil || oob.Err == nil || !strings.Contains(oob.Err.Error(), "out-of-band") {
+		t.Errorf("batch of an out-of-band URL = %v, item error %v", err, oob.Err)
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("test commands use POSIX sh syntax")
+	}
+	child, err := startBatchChild(t.Context(), "echo 'Then enter the code:'; echo '"+testDeviceURL+"'; sleep 0.2", 1)
+	if err != nil {
+		t.Fatalf("startBatchChild: %v", err)
+	}
+	if u, err := child.waitURL(t.Context(), 5*time.Second); u != testDeviceURL || err != nil {
+		t.Errorf("waitURL = %q, %v", u, err)
+	}
+	if err := child.finish(true); err != nil {
+		t.Errorf("finish: %v", err)
+	}
+
+	child, err = startBatchChild(t.Context(), "echo no url here", 2)
+	if err != nil {
+		t.Fatalf("startBatchChild: %v", err)
+	}
+	if _, err := child.waitURL(t.Context(), 5*time.Second); err == nil {
+		t.Error("expected an error for output without a URL")
+	}
+	child.finish(false)
+
+	// An interrupted run kills the command rather than leaving it waiting.
+	ctx, cancel := context.WithCancel(t.Context())
+	child, err = startBatchChild(ctx, "echo '"+testDeviceURL+"'; sleep 30", 3)
+	if err != nil {
+		t.Fatalf("startBatchChild: %v", err)
+	}
+	cancel()
+	select {
+	case <-child.done:
+	case <-time.After(10 * time.Second):
+		t.Error("the command outlived the cancelled run")
+	}
+}
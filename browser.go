@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net/url"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,7 +16,6 @@ import (
 	"github.com/go-rod/rod/lib/input"
 	"github.com/go-rod/rod/lib/launcher"
 	"github.com/go-rod/rod/lib/proto"
-	"github.com/pquerna/otp/totp"
 )
 
 const (
@@ -29,7 +29,16 @@ const (
 	// because, unlike the device flow, this page is reached by a redirect chain
 	// whose input numbering we don't control. MFA here is conditional — AWS only
 	// prompts sometimes — so this is probed for, not required.
-	XPathDexMFA          = `//input[@placeholder="Enter code"]`
+	XPathDexMFA = `//input[@placeholder="Enter code"]`
+	// XPathMFAError, given the MFA field's XPath, matches the inline error
+	// the AWS sign-in page shows in that field's own form field when the
+	// submitted code is rejected. Alerts elsewhere on the page and empty
+	// error placeholders don't count.
+	XPathMFAError = `%s/ancestor::*[contains(concat(" ", normalize-space(@class), " "), " awsui-form-field ")][1]//*[(@role="alert" or contains(@class, "awsui-form-field-error")) and normalize-space()]`
+	// XPathPasswordError matches the error the AWS sign-in page shows in the
+	// password's form ("Incorrect username or password") when the credentials
+	// are rejected.
+	XPathPasswordError   = XPathPassword + `/ancestor::form[1]//*[(@role="alert" or contains(@class, "awsui-form-field-error")) and normalize-space()]`
 	XPathAllow1          = `//*[@id="cli_verification_btn"]`
 	XPathAllow2          = `//*[@data-testid="allow-access-button"]`
 	XPathSuccess         = `//*[@data-analytics-alert="success"]`
@@ -42,6 +51,9 @@ const (
 	// DumpTimeout bounds each failure-dump capture so debugging a stuck page
 	// can never hang as long as the operation that failed.
 	DumpTimeout = 10 * time.Second
+	// BrowserExitWait bounds waiting for a launched browser to exit once
+	// closed, before it is killed so its user-data-dir can be removed.
+	BrowserExitWait = 10 * time.Second
 )
 
 // diagJS asks the page what element is at the center of each known Allow
@@ -120,13 +132,13 @@ func dismissCookieBanner(page *rod.Page) {
 
 // Helper function to find an element with consistent error handling
 func findElement(
-	page *rod.Page,
+	w *pageWatch,
 	xpath string,
 	description string,
 	timeout time.Duration,
 ) (*rod.Element, error) {
 	log.Debug("Looking for element", "description", description, "xpath", xpath)
-	element, err := page.Timeout(timeout).ElementX(xpath)
+	element, err := w.element(xpath, description, timeout)
 	if err != nil {
 		return nil, fmt.Errorf("%s not found with XPath %s: %v", description, xpath, err)
 	}
@@ -134,21 +146,27 @@ func findElement(
 	return element, nil
 }
 
-// Helper function to fill a field and submit the form
+// Helper function to fill a field and submit the form. The value is a Secret
+// so that it can never end up in a log line or error message.
 func fillAndSubmitField(
-	page *rod.Page,
+	w *pageWatch,
 	xpath string,
-	value string,
+	value Secret,
 	description string,
 	timeout time.Duration,
 ) error {
-	field, err := findElement(page, xpath, description, timeout)
+	field, err := findElement(w, xpath, description, timeout)
 	if err != nil {
 		return err
 	}
 
+	return inputAndSubmit(field, value, description)
+}
+
+// inputAndSubmit types value into an already-found field and presses Enter.
+func inputAndSubmit(field *rod.Element, value Secret, description string) error {
 	log.Debug("Filling field", "description", description)
-	if err := field.Input(value); err != nil {
+	if err := field.Input(value.Reveal()); err != nil {
 		return fmt.Errorf("failed to input %s: %v", description, err)
 	}
 
@@ -160,9 +178,113 @@ func fillAndSubmitField(
 	return nil
 }
 
+// fill2FAField waits for the MFA field and only then obtains the code, so
+// time-sensitive sources (TOTP, --2fa-cmd) yield a code that is still fresh
+// when submitted. The outcome is checked: accepted reports whether the page
+// moved past MFA. A code rejected by the page fails the login as rejected,
+// except that one from --2fa-cmd re-runs the command up to TwoFACmdAttempts
+// times first.
+func fill2FAField(
+	w *pageWatch,
+	xpath string,
+	description string,
+	config *Config,
+	flow string,
+	accepted pageCheck,
+	timeout time.Duration,
+) error {
+	field, err := findElement(w, xpath, description, timeout)
+	if err != nil {
+		return err
+	}
+
+	mctx := mfaContext{Flow: flow, Host: urlHost(w.URL())}
+	for attempt := 1; ; attempt++ {
+		mctx.Attempt = attempt
+		twoFA, err := get2FACode(w.ctx, config, mctx)
+		if err != nil {
+			return fmt.Errorf("failed to get 2FA code: %v", err)
+		}
+
+		err = inputAndSubmit(field, twoFA, description)
+		twoFA.Wipe()
+		if err != nil {
+			return err
+		}
+
+		ok, err := wait2FAOutcome(w, xpath, accepted, timeout)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if !config.usesTwoFACmd() {
+			return credentialsRejected(config, "the 2FA code was rejected: %s", errorText(w, fmt.Sprintf(XPathMFAError, xpath), "invalid code"))
+		}
+		if attempt >= TwoFACmdAttempts {
+			return credentialsRejected(config, "2FA code from --2fa-cmd was rejected %d times", attempt)
+		}
+
+		log.Warn("2FA code was rejected, re-running 2FA command", "attempt", attempt)
+		if field, err = findElement(w, xpath, description, timeout); err != nil {
+			return err
+		}
+		// Clear the rejected code so the next one isn't appended to it.
+		if err := field.SelectAllText(); err != nil {
+			return fmt.Errorf("failed to clear %s: %v", description, err)
+		}
+	}
+}
+
+// wait2FAOutcome waits, until the timeout, for whichever comes first after
+// an MFA code is submitted into the field at xpath: the flow moving on
+// (accepted passes, returns true) or the field showing an error (returns
+// false).
+func wait2FAOutcome(w *pageWatch, xpath string, accepted pageCheck, timeout time.Duration) (bool, error) {
+	first, err := w.wait(timeout, "the 2FA code to be accepted", accepted, hasX(fmt.Sprintf(XPathMFAError, xpath)))
+	if err != nil {
+		return false, err
+	}
+	return first == 0, nil
+}
+
+// waitPasswordAccepted waits, until the timeout, for the AWS sign-in page to
+// take the submitted password, i.e. for the password field to go, or to
+// reject the credentials.
+func waitPasswordAccepted(w *pageWatch, config *Config, timeout time.Duration) error {
+	first, err := w.wait(timeout, "the password to be accepted", hasX(XPathPasswordError), lacksX(XPathPassword))
+	if err != nil {
+		return err
+	}
+	if first == 0 {
+		return credentialsRejected(config, "AWS rejected the credentials: %s", errorText(w, XPathPasswordError, "incorrect username or password"))
+	}
+	return nil
+}
+
+// credentialsRejected marks the login as failed because its credentials or
+// MFA code were rejected, so logins waiting for this one don't retry them
+// (see afterConcurrentLogin), and returns the error.
+func credentialsRejected(config *Config, format string, args ...any) error {
+	config.rejected = true
+	return fmt.Errorf(format, args...)
+}
+
+// errorText returns the trimmed text of the error element at xpath, or
+// fallback if it has none.
+func errorText(w *pageWatch, xpath, fallback string) string {
+	if el, err := w.page.ElementX(xpath); err == nil {
+		if text, err := el.Text(); err == nil && strings.TrimSpace(text) != "" {
+			return strings.TrimSpace(text)
+		}
+	}
+	return fallback
+}
+
 // Helper function to click a button with consistent error handling
-func clickButton(page *rod.Page, xpath string, description string, timeout time.Duration) error {
-	button, err := findElement(page, xpath, description, timeout)
+func clickButton(w *pageWatch, xpath string, description string, timeout time.Duration) error {
+	button, err := findElement(w, xpath, description, timeout)
 	if err != nil {
 		return err
 	}
@@ -175,30 +297,44 @@ func clickButton(page *rod.Page, xpath string, description string, timeout time.
 	return nil
 }
 
-// Helper function to get 2FA code
-func get2FACode(config *Config) (string, error) {
-	if config.TwoFA != "" {
+// Helper function to get 2FA code. The caller owns the returned Secret and
+// should wipe it once submitted.
+func get2FACode(ctx context.Context, config *Config, mctx mfaContext) (Secret, error) {
+	if config.TwoFA.IsSet() {
 		log.Debug("Using 2FA code from command line")
-		return config.TwoFA, nil
+		return NewSecret(config.TwoFA.Reveal()), nil
 	}
 
-	if config.TOTPSecret != "" {
+	if config.TOTPSecret.IsSet() {
 		log.Debug("Generating 2FA code from TOTP secret...")
-		return totp.GenerateCode(config.TOTPSecret, time.Now())
+		opts, err := totpOpts(config.TOTP)
+		if err != nil {
+			return Secret{}, err
+		}
+		return totpCode(ctx, config.TOTPSecret, opts, time.Now)
 	}
 
-	twoFA, err := promptForInput("Enter 2FA code: ", false)
+	if config.TwoFACmd != "" {
+		log.Debug("Getting 2FA code from 2FA command...")
+		code, err := runTwoFACommand(ctx, config, mctx)
+		if err != nil {
+			return Secret{}, err
+		}
+		return NewSecret(code), nil
+	}
+
+	twoFA, err := promptForSecret(ctx, config, "Enter 2FA code: ", false)
 	if err != nil {
-		return "", fmt.Errorf("failed to get 2FA code interactively: %v", err)
+		return Secret{}, fmt.Errorf("failed to get 2FA code interactively: %v", err)
 	}
-	log.Debugf("Using 2FA code from interactive prompt: %s", twoFA)
+	log.Debug("Using 2FA code from interactive prompt")
 	return twoFA, nil
 }
 
 // Helper function to check for success message
-func checkSuccessMessage(page *rod.Page, timeout time.Duration) error {
+func checkSuccessMessage(w *pageWatch, timeout time.Duration) error {
 	log.Debug("Checking for success message...")
-	_, err := page.Timeout(timeout).ElementX(XPathSuccess)
+	_, err := w.element(XPathSuccess, "the success message", timeout)
 	if err != nil {
 		return fmt.Errorf("success message not found with XPath %s: %v", XPathSuccess, err)
 	}
@@ -213,115 +349,490 @@ func checkSuccessMessage(page *rod.Page, timeout time.Duration) error {
 	return nil
 }
 
-func automateBrowserLogin(deviceURL string, config *Config) error {
+// newLauncher configures the browser launcher for a login, with the binary
+// picked by resolveBrowserBin, the proxy from resolveProxy, the --ca-file
+// and any --browser-flag. `doctor` probes the browser with the same setup.
+func newLauncher(config *Config, bin browserBinary, proxy *proxySettings) (*launcher.Launcher, error) {
+	l := launcher.New().Headless(!config.ShowBrowser)
+	if bin.Path != "" {
+		l = l.Bin(bin.Path)
+	}
+	switch {
+	case proxy.PAC != "":
+		l = l.Set("proxy-pac-url", proxy.PAC)
+	case proxy.Server != "":
+		l = l.Proxy(proxy.Server)
+	case config.Proxy == ProxyDirect:
+		l = l.Set("no-proxy-server")
+	}
+	if proxy.Bypass != "" {
+		l = l.Set("proxy-bypass-list", proxy.Bypass)
+	}
+	if config.CAFile != "" {
+		hashes, err := caSPKIHashes(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		l = l.Set("ignore-certificate-errors-spki-list", strings.Join(hashes, ","))
+	}
+	for _, f := range config.BrowserFlags {
+		name, value, hasValue, _ := parseBrowserFlag(f) // validated in ValidateConfig
+		if hasValue {
+			l = l.Set(name, value)
+		} else {
+			l = l.Set(name)
+		}
+	}
+	return l, nil
+}
+
+// automateBrowserLogin runs the login in a browser, the pre-launched one if
+// warm is usable.
+func automateBrowserLogin(ctx context.Context, deviceURL string, config *Config, warm *browserPrelaunch) (err error) {
 	log.Info("Starting browser automation...")
 
+	session, err := warm.take(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			session.linger(ctx)
+		}
+		session.close()
+	}()
+
+	if err = session.login(ctx, deviceURL, config); err != nil {
+		return err
+	}
+	session.saveProfile()
+
+	log.Info("Browser automation completed!")
+	return nil
+}
+
+// browserSession is a launched and connected browser, plus the persistent
+// profile it runs on, if any. Several logins can share it.
+type browserSession struct {
+	browser     *rod.Browser
+	profile     *browserProfile
+	showBrowser bool
+	// disconnect drops the connection to a remote browser, which is left
+	// running; nil for a browser we launched.
+	disconnect func()
+	// Credentials for the launched browser's proxy, answered by
+	// interceptRequests.
+	proxyUser     string
+	proxyPassword Secret
+	// stops are run in order once the browser is done with, e.g. to wipe
+	// the proxy password.
+	stops []func()
+}
+
+// launchBrowser launches and connects to the browser for a login, on the
+// identity's persistent profile when --persist-session is on. With
+// --browser-ws or --browser-url it attaches to a running browser instead.
+// Cancelling ctx aborts a launch or download in progress.
+func launchBrowser(ctx context.Context, config *Config) (*browserSession, error) {
+	// The stored profile is discarded with --fresh-session even when nothing
+	// new will be stored.
+	var profile *browserProfile
+	if config.PersistSession || config.FreshSession {
+		p, err := config.browserProfile()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.acquire(ctx); err != nil {
+			return nil, err
+		}
+		if config.FreshSession {
+			log.Info("Discarding stored browser session", "profile", p.Name)
+			if err := p.reset(); err != nil {
+				p.release()
+				return nil, err
+			}
+		}
+		if !config.PersistSession {
+			p.release()
+		} else if err := p.prepare(); err != nil {
+			p.release()
+			return nil, err
+		} else {
+			profile = p
+		}
+	}
+
+	var (
+		session *browserSession
+		err     error
+	)
+	if config.usesRemoteBrowser() {
+		session, err = attachRemoteBrowser(config)
+	} else {
+		session, err = startLocalBrowser(ctx, config, profile)
+	}
+	if err != nil {
+		if profile != nil {
+			profile.release()
+		}
+		return nil, err
+	}
+	session.profile = profile
+	if profile != nil {
+		// After the browser has exited and its user-data-dir is removed.
+		session.stops = append(session.stops, profile.release)
+	}
+	session.showBrowser = config.ShowBrowser && session.disconnect == nil // a remote browser isn't ours to keep open
+
+	if profile != nil {
+		if err := profile.restoreCookies(session.browser); err != nil {
+			log.Warn("Could not restore stored browser session; signing in from scratch", "profile", profile.Name, "error", err)
+		}
+	}
+	return session, nil
+}
+
+// startLocalBrowser launches a browser with newLauncher's setup and connects
+// to it. A persistent profile provides its user-data-dir. The browser's
+// user-data-dir is removed once it has exited.
+func startLocalBrowser(ctx context.Context, config *Config, profile *browserProfile) (*browserSession, error) {
 	// Setup launcher
 	if config.ShowBrowser {
 		log.Info("Browser will be visible")
 	} else {
 		log.Info("Running browser in headless mode")
 	}
-	l := launcher.New().Headless(!config.ShowBrowser)
+	bin, err := resolveBrowserBin(config)
+	if err != nil {
+		return nil, err
+	}
+	if bin.Source == BrowserSourceDownload {
+		if bin, err = downloadChromium(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	log.Info("Using browser", "path", bin.Path, "source", bin.Source)
+
+	proxy, err := config.resolveProxy()
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Server != "" || proxy.PAC != "" {
+		log.Info("Using proxy", "proxy", proxy.describe())
+	}
+	l, err := newLauncher(config, bin, proxy)
+	if err != nil {
+		proxy.wipe()
+		return nil, err
+	}
+	if config.CAFile != "" {
+		log.Info("Trusting CA certificates for this login", "file", config.CAFile)
+	}
+	if profile != nil {
+		l = l.UserDataDir(profile.userData)
+	}
+	l = l.Context(ctx)
 
 	url, err := l.Launch()
 	if err != nil {
-		return fmt.Errorf("failed to launch browser: %v", err)
+		proxy.wipe()
+		return nil, fmt.Errorf("failed to launch browser: %v", err)
 	}
 
 	// Connect to browser
 	browser := rod.New().ControlURL(url)
 	if err := browser.Connect(); err != nil {
-		return fmt.Errorf("failed to connect to browser at %s: %v", url, err)
+		proxy.wipe()
+		return nil, fmt.Errorf("failed to connect to browser at %s: %v", url, err)
 	}
-	defer func() {
-		if config.ShowBrowser && err != nil {
-			log.Warn(
-				"Browser will be closed after delay because of error",
-				"delaySeconds",
-				BrowserCloseDelay,
-			)
-			time.Sleep(BrowserCloseDelay)
-		}
-		if closeErr := browser.Close(); closeErr != nil {
-			log.Error("Failed to close browser", "error", closeErr)
-		}
+	if version, err := (proto.BrowserGetVersion{}).Call(browser); err == nil {
+		log.Info("Browser started", "version", version.Product)
+	} else {
+		log.Debug("Could not read browser version", "error", err)
+	}
+
+	return &browserSession{
+		browser:       browser,
+		proxyUser:     proxy.Username,
+		proxyPassword: proxy.Password,
+		stops:         []func(){proxy.wipe, func() { removeUserDataDir(l) }},
+	}, nil
+}
+
+// removeUserDataDir waits for a closed browser to exit, killing it if it
+// doesn't within BrowserExitWait, and removes its user-data-dir.
+func removeUserDataDir(l *launcher.Launcher) {
+	done := make(chan struct{})
+	go func() {
+		l.Cleanup()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(BrowserExitWait):
+		log.Warn("Browser did not exit; killing it")
+		l.Kill()
+		<-done
+	}
+}
 
-	// Open device URL
-	log.Info("Opening device URL", "url", deviceURL)
-	page, err := browser.Page(proto.TargetCreateTarget{URL: deviceURL})
+// attachRemoteBrowser connects to a running browser's DevTools endpoint and
+// opens an isolated (incognito) browser context in it, so the login neither
+// sees nor disturbs the browser's other tabs and cookies. Closing the session
+// disposes of that context only, then disconnects.
+func attachRemoteBrowser(config *Config) (*browserSession, error) {
+	endpoint := config.BrowserWS
+	if endpoint == "" {
+		resolved, err := launcher.ResolveURL(config.BrowserURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the DevTools endpoint of %s: %v", config.BrowserURL, err)
+		}
+		endpoint = resolved
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	remote := rod.New().Context(ctx).ControlURL(endpoint)
+	if err := remote.Connect(); err != nil {
+		cancel()
+		// The endpoint may carry an access token; only its host is shown.
+		return nil, fmt.Errorf("failed to connect to remote browser at %s: %v", urlHost(endpoint), err)
+	}
+
+	browser, err := remote.Incognito()
 	if err != nil {
-		return fmt.Errorf("failed to open page %s: %v", deviceURL, err)
+		cancel()
+		return nil, fmt.Errorf("failed to create an isolated browser context: %v", err)
+	}
+	log.Info("Attached to remote browser in an isolated context", "host", urlHost(endpoint), "context", browser.BrowserContextID)
+	return &browserSession{browser: browser, disconnect: cancel}, nil
+}
+
+// linger keeps a visible browser open for a while after a failed login, so
+// the page can be looked at, unless ctx is done (e.g. interrupted) first.
+func (s *browserSession) linger(ctx context.Context) {
+	if !s.showBrowser || ctx.Err() != nil {
+		return
 	}
+	log.Warn(
+		"Browser will be closed after delay because of error; interrupt to close it now",
+		"delaySeconds",
+		BrowserCloseDelay,
+	)
+	sleepContext(ctx, BrowserCloseDelay)
+}
+
+// close closes the browser and, once it has exited, removes its
+// user-data-dir.
+func (s *browserSession) close() {
+	// For a remote browser this disposes of our context and its tabs only.
+	if err := s.browser.Close(); err != nil {
+		log.Error("Failed to close browser", "error", err)
+	}
+	for _, stop := range s.stops {
+		stop()
+	}
+	if s.disconnect != nil {
+		s.disconnect()
+	}
+}
+
+// saveProfile stores the browser's session in the persistent profile, if any.
+func (s *browserSession) saveProfile() {
+	if s.profile == nil {
+		return
+	}
+	if err := s.profile.saveCookies(s.browser); err != nil {
+		log.Warn("Could not store browser session", "profile", s.profile.Name, "error", err)
+	}
+}
+
+// login opens loginURL in a new tab and runs the login steps there. The tab
+// starts blank so request interception is in place before the first request.
+// Every step on the tab stops when ctx is done. On any failure, cancellation
+// included, the page state is dumped to disk before the error is returned.
+func (s *browserSession) login(ctx context.Context, loginURL string, config *Config) error {
+	steps := newStepTimer()
+	page, err := s.browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return fmt.Errorf("failed to open a tab: %v", err)
+	}
+	page = page.Context(ctx)
+	watch, err := watchPage(page)
+	if err != nil {
+		return err
+	}
+	defer watch.close()
+	stopIntercepting, err := s.interceptRequests(page, loginURL, config, watch)
+	if err != nil {
+		return err
+	}
+
+	// Open device URL
+	log.Info("Opening device URL", "url", loginURL)
+	if err := page.Navigate(loginURL); err != nil {
+		stopIntercepting()
+		return fmt.Errorf("failed to open page %s: %v", loginURL, err)
+	}
+	steps.done("open")
 
 	// Run the login steps. On any failure, dump the page state to disk so the
 	// run can be investigated later, then propagate the error.
-	if err = performLoginSteps(page, config); err != nil {
+	err = performLoginSteps(watch, config, steps)
+	if err == nil && config.DexURL != "" && config.outOfBand() {
+		if err = captureOOBCode(watch, config, time.Duration(config.TimeoutSeconds)*time.Second); err == nil {
+			steps.done("code")
+		}
+	}
+	blocked := stopIntercepting()
+	steps.summary("blockedRequests", blocked)
+	if err != nil {
 		dumpFailureInfo(page, config, err)
 		return err
 	}
-
-	log.Info("Browser automation completed!")
 	return nil
 }
 
+// firstPage is the page a login starts from.
+type firstPage int
+
+const (
+	// pastSignIn is whatever follows the sign-in form, on a live session.
+	pastSignIn firstPage = iota
+	awsSignInForm
+	// dexLoginForm is the form of Dex's own password connector (see dex.go).
+	dexLoginForm
+)
+
 // performLoginSteps drives login on an already-opened page. The username and
 // password steps are shared by both flows (both land on the same AWS sign-in
 // form); after that it branches on whether this is the Dex auth-code flow or
-// the AWS device-code flow. Every step is bounded by the single --timeout
-// budget.
-func performLoginSteps(page *rod.Page, config *Config) error {
+// the AWS device-code flow. Each wait is bounded by --timeout on its own, so
+// the whole login can take several times that; --deadline bounds the run. A
+// restored browser session can skip the sign-in form entirely, so
+// the steps start from whichever page shows up. A Dex connector that isn't
+// AWS IAM Identity Center shows Dex's own login form, driven by
+// performDexPasswordSteps instead.
+func performLoginSteps(w *pageWatch, config *Config, steps *stepTimer) error {
 	timeout := time.Duration(config.TimeoutSeconds) * time.Second
 
-	// Fill credentials (shared by both flows)
-	log.Info("Filling AWS SSO credentials...")
-	if err := fillAndSubmitField(page, XPathUsername, config.Username, "username field", timeout); err != nil {
+	first, err := waitForSignInOrConsent(w, config, timeout)
+	if err != nil {
 		return err
 	}
+	steps.done("first-page")
 
-	if err := fillAndSubmitField(page, XPathPassword, config.Password, "password field", timeout); err != nil {
-		return err
+	if first == dexLoginForm {
+		return performDexPasswordSteps(w, config, steps, timeout)
+	}
+
+	signIn := first != pastSignIn
+	if signIn {
+		// Prompts deferred because of a stored session happen now.
+		if err := config.promptForCredentials(w.ctx); err != nil {
+			return err
+		}
+
+		// Fill credentials (shared by both flows)
+		log.Info("Filling AWS SSO credentials...")
+		username := NewSecret(config.Username)
+		defer username.Wipe()
+		if err := fillAndSubmitField(w, XPathUsername, username, "username field", timeout); err != nil {
+			return err
+		}
+		steps.done("username")
+
+		if err := fillAndSubmitField(w, XPathPassword, config.Password, "password field", timeout); err != nil {
+			return err
+		}
+		if err := waitPasswordAccepted(w, config, timeout); err != nil {
+			return err
+		}
+		steps.done("password")
+	} else {
+		log.Info("Already signed in; skipping credential entry")
 	}
 
 	if config.DexURL != "" {
-		return performDexAuthSteps(page, config, timeout)
+		return performDexAuthSteps(w, config, steps, timeout)
 	}
-	return performDeviceAuthSteps(page, config, timeout)
+	return performDeviceAuthSteps(w, config, signIn, steps, timeout)
 }
 
-// performDeviceAuthSteps completes the AWS device-code flow: a mandatory 2FA
-// step, then the two "Allow" authorization clicks, then the on-page success
-// check. This is the original AWS SSO behavior.
-func performDeviceAuthSteps(page *rod.Page, config *Config, timeout time.Duration) error {
-	// Get 2FA code and submit
-	twoFA, err := get2FACode(config)
+// waitForSignInOrConsent waits, until the timeout, for the first page of
+// the login: the AWS sign-in form, Dex's login form, or, with a live session,
+// whatever follows the sign-in — an Allow button in the device flow, the MFA
+// field or the callback in the Dex flow. Dex's connector chooser and
+// approval screen are handled on the way.
+func waitForSignInOrConsent(w *pageWatch, config *Config, timeout time.Duration) (firstPage, error) {
+	checks := []pageCheck{hasX(XPathUsername)}
+	if config.DexURL != "" {
+		callback, err := config.loginCallback()
+		if err != nil {
+			return pastSignIn, err
+		}
+		checks = append(checks, hasX(XPathDexLogin), hasX(XPathDexMFA), w.atCallback(callback))
+		first, err := dexWait(w, config, timeout, "the sign-in form", checks...)
+		if err != nil {
+			return pastSignIn, err
+		}
+		switch first {
+		case 0:
+			return awsSignInForm, nil
+		case 1:
+			return dexLoginForm, nil
+		}
+		return pastSignIn, nil
+	}
+	checks = append(checks, hasX(XPathAllow1), hasX(XPathAllow2))
+
+	first, err := w.wait(timeout, "the sign-in form", checks...)
 	if err != nil {
-		return fmt.Errorf("failed to get 2FA code: %v", err)
+		return pastSignIn, err
+	}
+	if first == 0 {
+		return awsSignInForm, nil
 	}
+	return pastSignIn, nil
+}
 
-	if err := fillAndSubmitField(page, XPathTOTP, twoFA, "2FA field", timeout); err != nil {
-		return err
+// performDeviceAuthSteps completes the AWS device-code flow: a 2FA step if
+// credentials were just entered, then the two "Allow" authorization clicks, then the on-page
+// success check. This is the original AWS SSO behavior.
+func performDeviceAuthSteps(w *pageWatch, config *Config, signedInNow bool, steps *stepTimer, timeout time.Duration) error {
+	// Submit 2FA; the code is obtained once the field is on screen. The flow
+	// has moved on once the first Allow button appears. A restored session
+	// has already been through it.
+	if signedInNow {
+		if err := fill2FAField(w, XPathTOTP, "2FA field", config, "device", hasX(XPathAllow1), timeout); err != nil {
+			return err
+		}
+		steps.done("2fa")
 	}
 
 	// Authorize access
 	log.Info("Authorizing AWS CLI access...")
 
 	// Dismiss cookie banner if it appears on the authorization page
-	dismissCookieBanner(page)
+	dismissCookieBanner(w.page)
+	steps.done("cookie-banner")
 
-	if err := clickButton(page, XPathAllow1, "first Allow button", timeout); err != nil {
-		return err
+	// A resumed session may land past the code confirmation.
+	if has, _, _ := w.page.HasX(XPathAllow2); !has {
+		if err := clickButton(w, XPathAllow1, "first Allow button", timeout); err != nil {
+			return err
+		}
 	}
 
-	if err := clickButton(page, XPathAllow2, "second Allow button", timeout); err != nil {
+	if err := clickButton(w, XPathAllow2, "second Allow button", timeout); err != nil {
 		return err
 	}
+	steps.done("allow")
 
 	// Verify login success
-	if err := checkSuccessMessage(page, timeout); err != nil {
+	if err := checkSuccessMessage(w, timeout); err != nil {
 		return err
 	}
+	steps.done("success")
 
 	return nil
 }
@@ -333,101 +844,69 @@ func performDeviceAuthSteps(page *rod.Page, config *Config, timeout time.Duratio
 // whichever happens first — the MFA field or the callback redirect — and only
 // fill 2FA when the MFA page actually appears. Success is the browser reaching
 // the redirect_uri (argocd's local callback server), not an on-page element.
-func performDexAuthSteps(page *rod.Page, config *Config, timeout time.Duration) error {
-	prefix, err := dexCallbackPrefix(config.DexURL)
+func performDexAuthSteps(w *pageWatch, config *Config, steps *stepTimer, timeout time.Duration) error {
+	callback, err := config.loginCallback()
 	if err != nil {
 		return err
 	}
 
-	log.Info("Waiting for MFA prompt or login callback...", "callbackPrefix", prefix)
-	mfaNeeded, err := waitForMFAOrCallback(page, prefix, timeout)
+	log.Info("Waiting for MFA prompt or login callback...", "callback", callback)
+	mfaNeeded, err := waitForMFAOrCallback(w, config, callback, timeout)
 	if err != nil {
 		return err
 	}
 
 	if !mfaNeeded {
 		log.Info("No MFA required; login callback reached")
+		steps.done("callback")
 		return nil
 	}
+	steps.done("mfa-page")
 
+	// The code is taken once its field goes: a Dex approval screen may come
+	// before the callback.
 	log.Info("MFA required; submitting 2FA code...")
-	twoFA, err := get2FACode(config)
-	if err != nil {
-		return fmt.Errorf("failed to get 2FA code: %v", err)
+	if err := fill2FAField(w, XPathDexMFA, "MFA code field", config, "dex", lacksX(XPathDexMFA), timeout); err != nil {
+		return err
 	}
+	steps.done("2fa")
 
-	if err := fillAndSubmitField(page, XPathDexMFA, twoFA, "MFA code field", timeout); err != nil {
+	log.Info("Waiting for login callback...", "callback", callback)
+	if err := waitForCallback(w, config, callback, timeout); err != nil {
 		return err
 	}
-
-	log.Info("Waiting for login callback...", "callbackPrefix", prefix)
-	return waitForCallback(page, prefix, timeout)
+	steps.done("callback")
+	return nil
 }
 
-// dexCallbackPrefix extracts the origin (scheme + host) of the Dex URL's
-// redirect_uri, e.g. "http://localhost:8085". The dex flow waits for the
-// browser's URL to start with this prefix as its success signal. The port is
-// taken from the URL itself so it tracks whatever local port the CLI chose.
-func dexCallbackPrefix(dexURL string) (string, error) {
-	u, err := url.Parse(dexURL)
-	if err != nil {
-		return "", fmt.Errorf("could not parse dex URL: %v", err)
-	}
-	redirect := u.Query().Get("redirect_uri")
-	if redirect == "" {
-		return "", fmt.Errorf("dex URL has no redirect_uri query parameter")
-	}
-	r, err := url.Parse(redirect)
+// waitForMFAOrCallback waits, until the timeout, for whichever comes first
+// after the password is submitted: the browser reaching the callback
+// (returns mfaNeeded=false) or the MFA code field appearing (returns
+// mfaNeeded=true). If neither happens before the deadline it returns an error.
+// A Dex approval screen on the way is approved.
+func waitForMFAOrCallback(w *pageWatch, config *Config, callback oidcCallback, timeout time.Duration) (bool, error) {
+	first, err := dexWait(w, config, timeout, "MFA prompt or redirect to "+callback.String(), w.atCallback(callback), hasX(XPathDexMFA))
 	if err != nil {
-		return "", fmt.Errorf("could not parse redirect_uri %q: %v", redirect, err)
+		return false, err
 	}
-	return r.Scheme + "://" + r.Host, nil
+	return first == 1, nil
 }
 
-// waitForMFAOrCallback polls, until the timeout, for whichever comes first
-// after the password is submitted: the browser reaching the callback prefix
-// (returns mfaNeeded=false) or the MFA code field appearing (returns
-// mfaNeeded=true). If neither happens before the deadline it returns an error.
-func waitForMFAOrCallback(page *rod.Page, prefix string, timeout time.Duration) (bool, error) {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		info, err := page.Info()
-		if err != nil {
-			return false, fmt.Errorf("failed to read page info: %v", err)
-		}
-		if strings.HasPrefix(info.URL, prefix) {
-			return false, nil
-		}
-
-		has, _, err := page.HasX(XPathDexMFA)
-		if err != nil {
-			return false, fmt.Errorf("failed to probe for MFA field: %v", err)
-		}
-		if has {
-			return true, nil
-		}
-
-		time.Sleep(300 * time.Millisecond)
-	}
-	return false, fmt.Errorf("timed out after %s waiting for MFA prompt or redirect to %s", timeout, prefix)
+// waitForCallback waits, until the timeout, for the browser to reach the
+// callback — the redirect to the CLI's local callback server that completes
+// the auth-code flow. A Dex approval screen on the way is approved.
+func waitForCallback(w *pageWatch, config *Config, callback oidcCallback, timeout time.Duration) error {
+	_, err := dexWait(w, config, timeout, "redirect to "+callback.String(), w.atCallback(callback))
+	return err
 }
 
-// waitForCallback polls, until the timeout, for the browser to reach a URL
-// starting with prefix — the redirect to the CLI's local callback server that
-// completes the auth-code flow.
-func waitForCallback(page *rod.Page, prefix string, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		info, err := page.Info()
-		if err != nil {
-			return fmt.Errorf("failed to read page info: %v", err)
-		}
-		if strings.HasPrefix(info.URL, prefix) {
-			return nil
-		}
-		time.Sleep(300 * time.Millisecond)
+// debugDir is where failure dumps go: --debug-dir, or a directory under the
+// OS temp dir.
+func debugDir(config *Config) string {
+	if config.DebugDir != "" {
+		return config.DebugDir
 	}
-	return fmt.Errorf("timed out after %s waiting for redirect to %s", timeout, prefix)
+	return filepath.Join(os.TempDir(), "awsssologin-failures")
 }
 
 // dumpFailureInfo writes the page HTML, a screenshot, and a metadata summary to
@@ -435,10 +914,7 @@ func waitForCallback(page *rod.Page, prefix string, timeout time.Duration) error
 // It is best-effort: each capture is bounded by DumpTimeout and individual
 // failures are logged but never abort the dump. Secrets are never written.
 func dumpFailureInfo(page *rod.Page, config *Config, automationErr error) {
-	dir := config.DebugDir
-	if dir == "" {
-		dir = filepath.Join(os.TempDir(), "awsssologin-failures")
-	}
+	dir := debugDir(config)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		log.Warn("Could not create debug dump directory", "dir", dir, "error", err)
 		return
@@ -446,8 +922,10 @@ func dumpFailureInfo(page *rod.Page, config *Config, automationErr error) {
 
 	base := filepath.Join(dir, "failure-"+time.Now().Format("20060102-150405"))
 
-	// Bound every page interaction so dumping a stuck page can't hang.
-	p := page.Timeout(DumpTimeout)
+	// Bound every page interaction so dumping a stuck page can't hang. The
+	// dump also runs when the login was cancelled, so it doesn't inherit
+	// the page's context.
+	p := page.Context(context.Background()).Timeout(DumpTimeout)
 
 	// Page info (URL + title) for the metadata summary.
 	url, title := "<unknown>", "<unknown>"
@@ -457,15 +935,8 @@ func dumpFailureInfo(page *rod.Page, config *Config, automationErr error) {
 		url, title = info.URL, info.Title
 	}
 
-	// Metadata summary — note we deliberately omit password/2FA/TOTP secrets.
 	var meta strings.Builder
-	fmt.Fprintf(&meta, "timestamp:       %s\n", time.Now().Format(time.RFC3339))
-	fmt.Fprintf(&meta, "error:           %v\n", automationErr)
-	fmt.Fprintf(&meta, "page_url:        %s\n", url)
-	fmt.Fprintf(&meta, "page_title:      %s\n", title)
-	fmt.Fprintf(&meta, "username:        %s\n", config.Username)
-	fmt.Fprintf(&meta, "timeout_s:       %d\n", config.TimeoutSeconds)
-	fmt.Fprintf(&meta, "show_browser:    %t\n", config.ShowBrowser)
+	writeDumpMetadata(&meta, config, automationErr, url, title)
 
 	// Interactability diagnostic — mirrors rod's Interactable check by calling
 	// elementFromPoint at each Allow button's center, so the dump answers
@@ -495,6 +966,19 @@ func dumpFailureInfo(page *rod.Page, config *Config, automationErr error) {
 	log.Warn("Failure debug info written", "dir", dir, "prefix", filepath.Base(base))
 }
 
+// writeDumpMetadata writes the metadata summary of a failure dump. We
+// deliberately omit password/2FA/TOTP secrets; they are Secrets, so even a
+// future field added here would print as [REDACTED].
+func writeDumpMetadata(meta io.Writer, config *Config, automationErr error, url, title string) {
+	fmt.Fprintf(meta, "timestamp:       %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(meta, "error:           %v\n", automationErr)
+	fmt.Fprintf(meta, "page_url:        %s\n", url)
+	fmt.Fprintf(meta, "page_title:      %s\n", title)
+	fmt.Fprintf(meta, "username:        %s\n", config.Username)
+	fmt.Fprintf(meta, "timeout_s:       %d\n", config.TimeoutSeconds)
+	fmt.Fprintf(meta, "show_browser:    %t\n", config.ShowBrowser)
+}
+
 // writeDumpFile writes a single debug artifact, logging on failure.
 func writeDumpFile(path string, data []byte) {
 	if err := os.WriteFile(path, data, 0o644); err != nil {
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/launcher/flags"
+)
+
+// Where the browser binary of a login came from.
+const (
+	BrowserSourceConfigured = "configured"
+	BrowserSourceDownloaded = "downloaded"
+	BrowserSourceSystem     = "system"
+	BrowserSourceDownload   = "download" // none found; the launcher downloads Chromium
+)
+
+// Environment variables for the browser binary settings.
+const (
+	EnvBrowserBin = "AWSSSOLOGIN_BROWSER_BIN"
+	EnvOffline    = "AWSSSOLOGIN_OFFLINE"
+)
+
+// managedBrowserFlags are launcher flags awsssologin sets itself; a
+// --browser-flag for one of them would break the login or the profile.
+var managedBrowserFlags = map[flags.Flag]string{
+	flags.RemoteDebuggingPort: "it is how awsssologin connects",
+	flags.UserDataDir:         "use --persist-session",
+	flags.Headless:            "use --show-browser",
+}
+
+// browserBinary is the browser a login launches. Path is empty only with
+// BrowserSourceDownload.
+type browserBinary struct {
+	Path   string
+	Source string
+}
+
+// resolveBrowserBin picks the browser binary: --browser-bin if given, else
+// Chromium previously downloaded by rod, else a system Chrome, Chromium or
+// Edge. With none of these, the launcher downloads Chromium, unless --offline
+// forbids it.
+func resolveBrowserBin(config *Config) (browserBinary, error) {
+	if config.BrowserBin != "" {
+		path, err := lookBrowserBin(expandHome(config.BrowserBin))
+		if err != nil {
+			return browserBinary{}, fmt.Errorf("browser binary %s not usable: %v", config.BrowserBin, err)
+		}
+		return browserBinary{Path: path, Source: BrowserSourceConfigured}, nil
+	}
+
+	b := launcher.NewBrowser()
+	if err := b.Validate(); err == nil {
+		return browserBinary{Path: b.BinPath(), Source: BrowserSourceDownloaded}, nil
+	}
+
+	if path, has := launcher.LookPath(); has {
+		return browserBinary{Path: path, Source: BrowserSourceSystem}, nil
+	}
+
+	if config.Offline {
+		return browserBinary{}, fmt.Errorf(
+			"no browser found and --offline forbids downloading Chromium r%d: "+
+				"install Chrome, Chromium or Edge, or pass --browser-bin", b.Revision)
+	}
+	return browserBinary{Source: BrowserSourceDownload}, nil
+}
+
+// downloadChromium downloads rod's pinned Chromium revision through the
+// configured proxy and CA.
+func downloadChromium(ctx context.Context, config *Config) (browserBinary, error) {
+	b := launcher.NewBrowser()
+	b.Context = ctx
+	log.Info("No browser found; downloading Chromium (use --browser-bin or --offline to prevent this)", "revision", b.Revision)
+	client, err := config.httpClient(0)
+	if err != nil {
+		return browserBinary{}, err
+	}
+	b.HTTPClient = client
+	path, err := b.Get()
+	if err != nil {
+		return browserBinary{}, fmt.Errorf("failed to download Chromium r%d: %v", b.Revision, err)
+	}
+	return browserBinary{Path: path, Source: BrowserSourceDownloaded}, nil
+}
+
+// lookBrowserBin resolves a --browser-bin value: a path, or a name looked up
+// in PATH.
+func lookBrowserBin(bin string) (string, error) {
+	if filepath.Base(bin) == bin {
+		return exec.LookPath(bin)
+	}
+	info, err := os.Stat(bin)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("is a directory")
+	}
+	return bin, nil
+}
+
+// checkOffline fails an --offline run that has no browser to launch, before
+// the URL is read or credentials are prompted for. An identity matched by a
+// URL read from stdin isn't applied yet, so its browser_bin isn't seen here.
+func (c *Config) checkOffline() error {
+	if !c.Offline || c.usesRemoteBrowser() {
+		return nil
+	}
+	_, err := resolveBrowserBin(c)
+	return err
+}
+
+// parseBrowserFlag splits a --browser-flag value, "name" or "name=value",
+// with or without leading dashes.
+func parseBrowserFlag(s string) (flags.Flag, string, bool, error) {
+	name, value, hasValue := strings.Cut(strings.TrimLeft(s, "-"), "=")
+	if name == "" {
+		return "", "", false, fmt.Errorf("invalid browser flag %q", s)
+	}
+	if why, ok := managedBrowserFlags[flags.Flag(name)]; ok {
+		return "", "", false, fmt.Errorf("browser flag --%s can't be set: %s", name, why)
+	}
+	return flags.Flag(name), value, hasValue, nil
+}
+
+// applyBrowserEnv applies the browser binary environment variables, which
+// rank below flags and above the settings files.
+func (c *Config) applyBrowserEnv() error {
+	if env := os.Getenv(EnvBrowserBin); env != "" && !c.flagChanged("browser-bin") {
+		c.BrowserBin = env
+	}
+	if env := os.Getenv(EnvOffline); env != "" && !c.flagChanged("offline") {
+		offline, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", EnvOffline, err)
+		}
+		c.Offline = offline
+	}
+	return nil
+}
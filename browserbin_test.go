@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-rod/rod/lib/launcher"
+)
+
+// TestResolveBrowserBin checks that a configured binary wins, that a missing
+// one is an error rather than a download, that --offline fails fast when no
+// browser is installed, and how --browser-flag values are parsed.
+func TestResolveBrowserBin(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "chromium")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolveBrowserBin(&Config{BrowserBin: bin})
+	if err != nil || got.Path != bin || got.Source != BrowserSourceConfigured {
+		t.Errorf("resolveBrowserBin(%s) = %+v, %v", bin, got, err)
+	}
+	if _, err := resolveBrowserBin(&Config{BrowserBin: bin + "-missing", Offline: true}); err == nil {
+		t.Error("missing --browser-bin resolved")
+	}
+
+	if !testing.Short() {
+		if _, has := launcher.LookPath(); !has && launcher.NewBrowser().Validate() != nil {
+			_, err := resolveBrowserBin(&Config{Offline: true})
+			if err == nil || !strings.Contains(err.Error(), "--offline") {
+				t.Errorf("offline with no browser: err = %v", err)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		in, name, value string
+		hasValue, ok    bool
+	}{
+		{"proxy-server=http://proxy:3128", "proxy-server", "http://proxy:3128", true, true},
+		{"--lang=de", "lang", "de", true, true},
+		{"ignore-certificate-errors", "ignore-certificate-errors", "", false, true},
+		{"--", "", "", false, false},
+		{"headless", "", "", false, false},
+		{"user-data-dir=/tmp/x", "", "", false, false},
+	} {
+		name, value, hasValue, err := parseBrowserFlag(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseBrowserFlag(%q) err = %v, want ok %t", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (string(name) != tt.name || value != tt.value || hasValue != tt.hasValue) {
+			t.Errorf("parseBrowserFlag(%q) = %q, %q, %t", tt.in, name, value, hasValue)
+		}
+	}
+}
@@ -1,46 +1,239 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
-	"syscall"
 
 	"github.com/charmbracelet/log"
-	"golang.org/x/term"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/spf13/pflag"
 )
 
 type Config struct {
 	Username       string
-	Password       string
-	TwoFA          string
-	TOTPSecret     string
+	Password       Secret
+	TwoFA          Secret
+	TOTPSecret     Secret
+	TwoFACmd       string
 	DeviceURL      string
 	DexURL         string
 	ShowBrowser    bool
 	TimeoutSeconds int
 	DebugDir       string
 	LogLevel       string
+	PromptBackend  string
+
+	// DeadlineSeconds bounds the whole run (--deadline); 0 for no limit.
+	DeadlineSeconds int
+
+	TwoFACmdTimeoutSeconds int
+	PinentryProgram        string
+
+	// File descriptors to read secrets from; -1 when unset.
+	PasswordFD        int
+	TOTPSecretFD      int
+	CredentialsFD     int
+	ForbidArgvSecrets bool
+
+	// Browser binary to launch and extra flags for it (see browserbin.go).
+	// Offline forbids downloading Chromium when no browser is found.
+	BrowserBin   string
+	BrowserFlags []string
+	Offline      bool
+	// BlockRequests blocks images, fonts and telemetry (see intercept.go).
+	BlockRequests bool
+	// RelayCallback relays the Dex callback from this process (see
+	// relay.go); relaysCallback applies its default.
+	RelayCallback bool
+	// DexConnector is the connector chosen on Dex's chooser, by ID or name;
+	// DexApproveClients are the client IDs granted access on its approval
+	// screen (see dex.go).
+	DexConnector      string
+	DexApproveClients []string
+
+	// Out-of-band auth-code logins (see oob.go): the login ends on a page
+	// showing the code, which is printed or, with OOBExec, typed into the
+	// command that printed the URL. OOBCode is the captured code.
+	OOB          bool
+	OOBExec      string
+	OOBCodeXPath string
+	OOBCode      Secret
+
+	// Network access of the launched browser (see proxy.go). ProxyUser is
+	// for proxies whose URL carries no user name, e.g. a PAC file's.
+	Proxy     string
+	ProxyPAC  string
+	ProxyUser string
+	CAFile    string
+
+	// DevTools endpoint of a running browser to attach to instead of
+	// launching one: a ws:// URL, or an http:// URL to resolve it from.
+	BrowserWS  string
+	BrowserURL string
+
+	// Persistent browser profile (see profile.go).
+	PersistSession bool
+	FreshSession   bool
+
+	// Config file (see configfile.go). Identity and SSOSession select one of
+	// its identities; TOTP comes only from the file.
+	ConfigFile string
+	Identity   string
+	SSOSession string
+	TOTP       totpParams
+
+	flags          *pflag.FlagSet // to tell flags given on the command line from defaults
+	allowNoURL     bool           // `config` subcommands don't need a URL source
+	settingsLoaded bool
+	file           *configFile
+	filePath       string
+	identityName   string          // identity applied from the file, if any
+	awsSessions    []awsSSOSession // [sso-session] sections of ~/.aws/config
+	awsSession     *awsSSOSession  // the one matching this login, if any
+	fileIdentity   identity        // merged file settings, for getCredentials
+	// rejected is set once the login's credentials or MFA code were
+	// rejected, so logins waiting for this one don't retry them.
+	rejected bool
+}
+
+// credentialsDocument is the JSON document accepted on --credentials-fd. Any
+// field may be omitted; flags and the per-secret fds take precedence.
+type credentialsDocument struct {
+	Username   string `json:"username"`
+	Password   Secret `json:"password"`
+	TwoFA      Secret `json:"2fa"`
+	TOTPSecret Secret `json:"totp_secret"`
 }
 
-// ValidateConfig validates configuration values and sets reasonable defaults
+// ValidateConfig validates configuration values and sets reasonable defaults.
+// Config file and ~/.aws/config values are merged in first, below flags and
+// env vars.
 func (c *Config) ValidateConfig() error {
+	if err := c.loadSettingsFiles(); err != nil {
+		return err
+	}
+
 	// Set default timeout if not provided or invalid
 	if c.TimeoutSeconds <= 0 {
 		return fmt.Errorf("timeout must be at least 1 second, got: %d", c.TimeoutSeconds)
 	}
 
+	if c.TwoFACmdTimeoutSeconds <= 0 {
+		return fmt.Errorf("2FA command timeout must be at least 1 second, got: %d", c.TwoFACmdTimeoutSeconds)
+	}
+
+	if c.DeadlineSeconds < 0 {
+		return fmt.Errorf("deadline must be 0 (none) or a number of seconds, got: %d", c.DeadlineSeconds)
+	}
+
 	// The two flows are driven by different entry URLs and cannot be combined.
+	if c.flagChanged("dex-url") && c.flagChanged("oidc-url") {
+		return fmt.Errorf("--dex-url and --oidc-url are mutually exclusive")
+	}
 	if c.DeviceURL != "" && c.DexURL != "" {
-		return fmt.Errorf("--device-url and --dex-url are mutually exclusive")
+		return fmt.Errorf("--device-url and --%s are mutually exclusive", c.authCodeFlag())
+	}
+	if c.OOBExec != "" && (c.DeviceURL != "" || c.DexURL != "") {
+		return fmt.Errorf("--oob-exec takes the URL from the command's output; it can't be combined with --device-url, --oidc-url or --dex-url")
+	}
+	if c.OOB && c.DeviceURL != "" {
+		return fmt.Errorf("--oob applies to the auth-code flow (--oidc-url, --dex-url), not --device-url")
+	}
+
+	if c.BrowserWS != "" && c.BrowserURL != "" {
+		return fmt.Errorf("--browser-ws and --browser-url are mutually exclusive")
+	}
+	if c.BrowserWS != "" {
+		if u, err := url.Parse(c.BrowserWS); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			return fmt.Errorf("--browser-ws must be a ws:// or wss:// URL")
+		}
+	}
+
+	if c.Proxy != "" && c.ProxyPAC != "" {
+		return fmt.Errorf("--proxy and --proxy-pac are mutually exclusive")
+	}
+	if c.usesRemoteBrowser() {
+		for _, flag := range []string{"proxy", "proxy-pac", "ca-file", "browser-bin", "browser-flag", "offline"} {
+			if c.flagChanged(flag) {
+				return fmt.Errorf("--%s only applies to a launched browser, not with --browser-ws or --browser-url", flag)
+			}
+		}
+	}
+	if !c.usesRemoteBrowser() {
+		proxy, err := c.resolveProxy()
+		if err != nil {
+			return err
+		}
+		proxy.wipe()
+		if c.CAFile != "" {
+			if _, err := readCAFile(c.CAFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range c.BrowserFlags {
+		if _, _, _, err := parseBrowserFlag(f); err != nil {
+			return err
+		}
+	}
+
+	// A secret given both inline and via a file descriptor is ambiguous.
+	if c.Password.IsSet() && c.PasswordFD >= 0 {
+		return fmt.Errorf("--password and --password-fd are mutually exclusive")
+	}
+	if c.TOTPSecret.IsSet() && c.TOTPSecretFD >= 0 {
+		return fmt.Errorf("--totp-secret and --totp-secret-fd are mutually exclusive")
+	}
+
+	// Each descriptor is read to EOF, so it can serve only one flag, and fd 0
+	// can't be used when it is the pipe carrying the URL.
+	seen := map[int]string{}
+	for _, fd := range []struct {
+		flag string
+		fd   int
+	}{
+		{"--password-fd", c.PasswordFD},
+		{"--totp-secret-fd", c.TOTPSecretFD},
+		{"--credentials-fd", c.CredentialsFD},
+	} {
+		if fd.fd < 0 {
+			continue
+		}
+		if fd.fd == 0 && c.usesStdin() {
+			return fmt.Errorf("%s can't be 0 when the URL is read from stdin ('-')", fd.flag)
+		}
+		if other, ok := seen[fd.fd]; ok {
+			return fmt.Errorf("%s and %s can't share file descriptor %d", other, fd.flag, fd.fd)
+		}
+		seen[fd.fd] = fd.flag
+	}
+
+	if _, err := totpOpts(c.TOTP); err != nil {
+		return fmt.Errorf("invalid TOTP parameters: %v", err)
+	}
+
+	switch c.PromptBackend {
+	case PromptBackendTTY, PromptBackendPinentry:
+	case PromptBackendStdin:
+		if c.usesStdin() {
+			return fmt.Errorf("--prompt-backend stdin can't be used when the URL is read from stdin ('-')")
+		}
+	default:
+		return fmt.Errorf("invalid prompt backend %q: must be one of tty, pinentry, stdin", c.PromptBackend)
 	}
 
 	// A URL source is mandatory and always explicit: a literal URL, or "-" to
 	// read it from stdin. There is no implicit default.
-	if c.DeviceURL == "" && c.DexURL == "" {
-		return fmt.Errorf("no URL source: pass --device-url, --dex-url, or either with '-' to read from stdin")
+	if c.DeviceURL == "" && c.DexURL == "" && c.OOBExec == "" && !c.allowNoURL {
+		return fmt.Errorf("no URL source: pass --device-url, --oidc-url, --dex-url, any of them with '-' to read from stdin, or --oob-exec")
 	}
 
 	// Validate device URL format when a literal URL is given ("-" means stdin).
@@ -53,23 +246,99 @@ func (c *Config) ValidateConfig() error {
 	// Validate Dex URL format when a literal URL is given ("-" means stdin).
 	if c.DexURL != "" && c.DexURL != StdinURLSource {
 		if err := validateDexURL(c.DexURL); err != nil {
-			return fmt.Errorf("invalid dex URL: %v", err)
+			return fmt.Errorf("invalid --%s URL: %v", c.authCodeFlag(), err)
 		}
 	}
 
 	return nil
 }
 
+// applyLogLevel sets the global log level from the config.
+func (c *Config) applyLogLevel() error {
+	logLevel, err := log.ParseLevel(c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %v", err)
+	}
+	log.SetLevel(logLevel)
+	return nil
+}
+
+// totpOpts turns TOTP parameters into generation options, filling in the
+// standard 6 digits, 30 s period and SHA1 for unset values.
+func totpOpts(p totpParams) (totp.ValidateOpts, error) {
+	opts := totp.ValidateOpts{Period: 30, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	if p.Period != 0 {
+		opts.Period = p.Period
+	}
+	switch p.Digits {
+	case 0, 6:
+	case 8:
+		opts.Digits = otp.DigitsEight
+	default:
+		return opts, fmt.Errorf("digits must be 6 or 8, got: %d", p.Digits)
+	}
+	switch strings.ToUpper(p.Algorithm) {
+	case "", "SHA1":
+	case "SHA256":
+		opts.Algorithm = otp.AlgorithmSHA256
+	case "SHA512":
+		opts.Algorithm = otp.AlgorithmSHA512
+	default:
+		return opts, fmt.Errorf("algorithm must be SHA1, SHA256 or SHA512, got: %q", p.Algorithm)
+	}
+	return opts, nil
+}
+
 // usesStdin reports whether the login URL will be read from stdin, which is the
-// case when either URL flag is set to "-". Interactive credential prompts are
-// impossible in that case because the pipe owns stdin.
+// case when either URL flag is set to "-". The pipe then owns stdin, so
+// interactive prompts must go through the controlling terminal (see openTTY).
 func (c *Config) usesStdin() bool {
 	return c.DeviceURL == StdinURLSource || c.DexURL == StdinURLSource
 }
 
 // hasIncompleteCredentials returns true if any required credentials are missing
 func (c *Config) hasIncompleteCredentials() bool {
-	return c.Username == "" || c.Password == "" || (c.TwoFA == "" && c.TOTPSecret == "")
+	return c.Username == "" || !c.Password.IsSet() || (!c.TwoFA.IsSet() && !c.TOTPSecret.IsSet() && c.TwoFACmd == "")
+}
+
+// authCodeFlag names the flag the auth-code URL was given with.
+func (c *Config) authCodeFlag() string {
+	if c.flagChanged("oidc-url") {
+		return "oidc-url"
+	}
+	return "dex-url"
+}
+
+// usesRemoteBrowser reports whether logins attach to a running browser
+// instead of launching one.
+func (c *Config) usesRemoteBrowser() bool {
+	return c.BrowserWS != "" || c.BrowserURL != ""
+}
+
+// relaysCallback reports whether the Dex callback is relayed to the CLI's
+// listener from this process: as set by --relay-callback or the settings
+// files, else whenever the browser is remote, as it may not reach the
+// listener itself.
+func (c *Config) relaysCallback() bool {
+	if c.flagChanged("relay-callback") || c.fileIdentity.RelayCallback != nil {
+		return c.RelayCallback
+	}
+	return c.usesRemoteBrowser()
+}
+
+// usesTwoFACmd reports whether the 2FA code will come from --2fa-cmd, i.e. the
+// command is set and no higher-priority static code or TOTP secret is.
+func (c *Config) usesTwoFACmd() bool {
+	return !c.TwoFA.IsSet() && !c.TOTPSecret.IsSet() && c.TwoFACmd != ""
+}
+
+// urlHost returns the host of rawURL, or "" if it has none.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
 }
 
 // validateDeviceURL checks if the device URL matches the expected AWS SSO pattern
@@ -80,10 +349,11 @@ func validateDeviceURL(rawURL string) error {
 	return nil
 }
 
-// validateDexURL checks that the Dex auth URL is a parseable http(s) URL that
-// carries a redirect_uri. The redirect_uri is where the browser lands once
-// login succeeds, so the dex flow uses it as its success signal — without it
-// there is nothing to wait for.
+// validateDexURL checks that the auth URL is a parseable http(s) URL that
+// carries a redirect_uri, or is a loopback URL of the CLI's own listener. The
+// redirect_uri is where the browser lands once login succeeds, so the
+// auth-code flow uses it as its success signal — without it there is nothing
+// to wait for (see oidcCallbackFor).
 func validateDexURL(rawURL string) error {
 	u, err := url.Parse(rawURL)
 	if err != nil {
@@ -92,16 +362,116 @@ func validateDexURL(rawURL string) error {
 	if u.Scheme != "http" && u.Scheme != "https" {
 		return fmt.Errorf("URL scheme must be http or https, got %q", u.Scheme)
 	}
-	if u.Query().Get("redirect_uri") == "" {
-		return fmt.Errorf("URL is missing the redirect_uri query parameter")
+	if u.Query().Get("redirect_uri") == "" && !isLoopbackURL(u) {
+		return fmt.Errorf("URL is missing the redirect_uri query parameter and isn't a loopback URL of the CLI's listener")
 	}
 	return nil
 }
 
-func getCredentials(config *Config) error {
-	// Username: CLI -> ENV
+// argvSecrets names the secrets that were passed as plain flag values.
+// Those are visible to every local user through the process list
+// (/proc/*/cmdline), unlike file descriptors or environment variables.
+// It must be called before environment variables are merged in.
+func (c *Config) argvSecrets() []string {
+	var names []string
+	if c.Password.IsSet() {
+		names = append(names, "--password")
+	}
+	if c.TOTPSecret.IsSet() {
+		names = append(names, "--totp-secret")
+	}
+	if c.flagChanged("proxy") {
+		if u, err := url.Parse(c.Proxy); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				names = append(names, "--proxy")
+			}
+		}
+	}
+	return names
+}
+
+// readFD reads an inherited file descriptor (e.g. 3<<<"$secret") to EOF and
+// trims the trailing newline a here-string adds. It returns nil when fd is
+// unset (negative). The caller owns, and should clear, the returned bytes.
+func readFD(fd int) ([]byte, error) {
+	if fd < 0 {
+		return nil, nil
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("file descriptor %d is not valid", fd)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file descriptor %d: %v", fd, err)
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("file descriptor %d is empty", fd)
+	}
+	return data, nil
+}
+
+// readSecretFD reads a secret from an inherited file descriptor straight into
+// a Secret. It returns an unset Secret when fd is unset (negative).
+func readSecretFD(fd int) (Secret, error) {
+	data, err := readFD(fd)
+	if err != nil {
+		return Secret{}, err
+	}
+	return secretFromBytes(data), nil
+}
+
+// readCredentialsFD reads a JSON credentialsDocument from an inherited file
+// descriptor. Unknown keys are rejected so typos don't silently drop a
+// credential. It returns an empty document when fd is unset (negative).
+func readCredentialsFD(fd int) (credentialsDocument, error) {
+	var doc credentialsDocument
+	raw, err := readFD(fd)
+	if err != nil || raw == nil {
+		return doc, err
+	}
+	defer clear(raw)
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return doc, fmt.Errorf("invalid credentials JSON on file descriptor %d: %v", fd, err)
+	}
+	return doc, nil
+}
+
+func getCredentials(ctx context.Context, config *Config) error {
+	// Secrets on argv leak through the process list: warn, or refuse outright
+	// with --forbid-argv-secrets.
+	if names := config.argvSecrets(); len(names) > 0 {
+		if config.ForbidArgvSecrets {
+			return fmt.Errorf("secrets passed on the command line (%s) are forbidden by --forbid-argv-secrets; use --password-fd, --credentials-fd or environment variables", strings.Join(names, ", "))
+		}
+		log.Warn("Secrets passed on the command line are visible in the process list; prefer --password-fd, --credentials-fd or environment variables", "flags", strings.Join(names, ", "))
+	}
+
+	passwordFD, err := readSecretFD(config.PasswordFD)
+	if err != nil {
+		return fmt.Errorf("failed to read password: %v", err)
+	}
+	totpSecretFD, err := readSecretFD(config.TOTPSecretFD)
+	if err != nil {
+		return fmt.Errorf("failed to read TOTP secret: %v", err)
+	}
+	creds, err := readCredentialsFD(config.CredentialsFD)
+	if err != nil {
+		return err
+	}
+
+	// Username: CLI -> FD -> ENV
 	if config.Username == "" {
-		if env := os.Getenv("AWSSSOLOGIN_USERNAME"); env != "" {
+		if creds.Username != "" {
+			config.Username = creds.Username
+			log.Info("Using username from credentials file descriptor", "username", config.Username)
+		} else if env := os.Getenv("AWSSSOLOGIN_USERNAME"); env != "" {
 			config.Username = env
 			log.Info("Using username from environment variable", "username", config.Username)
 		}
@@ -109,94 +479,112 @@ func getCredentials(config *Config) error {
 		log.Info("Using username from command line", "username", config.Username)
 	}
 
-	// Password: CLI -> ENV
-	if config.Password == "" {
-		if env := os.Getenv("AWSSSOLOGIN_PASSWORD"); env != "" {
-			config.Password = env
+	// Password: CLI -> FD -> ENV
+	if !config.Password.IsSet() {
+		if passwordFD.IsSet() {
+			config.Password = passwordFD
+			log.Info("Using password from file descriptor", "fd", config.PasswordFD)
+		} else if creds.Password.IsSet() {
+			config.Password = creds.Password
+			log.Info("Using password from credentials file descriptor")
+		} else if env := os.Getenv("AWSSSOLOGIN_PASSWORD"); env != "" {
+			config.Password = NewSecret(env)
 			log.Info("Using password from environment variable")
 		}
 	} else {
 		log.Info("Using password from command line")
 	}
 
-	// 2FA: CLI -> ENV
-	if config.TwoFA == "" {
-		if env := os.Getenv("AWSSSOLOGIN_2FA"); env != "" {
-			config.TwoFA = env
+	// 2FA: CLI -> FD -> ENV
+	if !config.TwoFA.IsSet() {
+		if creds.TwoFA.IsSet() {
+			config.TwoFA = creds.TwoFA
+			log.Info("Using 2FA code from credentials file descriptor")
+		} else if env := os.Getenv("AWSSSOLOGIN_2FA"); env != "" {
+			config.TwoFA = NewSecret(env)
 			log.Info("Using 2FA code from environment variable")
 		}
 	} else {
 		log.Info("Using 2FA code from command line")
 	}
 
-	// TOTP Secret: CLI -> ENV
-	if config.TOTPSecret == "" {
-		if env := os.Getenv("AWSSSOLOGIN_TOTP_SECRET"); env != "" {
-			config.TOTPSecret = env
+	// TOTP Secret: CLI -> FD -> ENV
+	if !config.TOTPSecret.IsSet() {
+		if totpSecretFD.IsSet() {
+			config.TOTPSecret = totpSecretFD
+			log.Info("Using TOTP secret from file descriptor", "fd", config.TOTPSecretFD)
+		} else if creds.TOTPSecret.IsSet() {
+			config.TOTPSecret = creds.TOTPSecret
+			log.Info("Using TOTP secret from credentials file descriptor")
+		} else if env := os.Getenv("AWSSSOLOGIN_TOTP_SECRET"); env != "" {
+			config.TOTPSecret = NewSecret(env)
 			log.Info("Using TOTP secret from environment variable")
 		}
 	} else {
 		log.Info("Using TOTP secret from command line")
 	}
 
-	// Interactive prompt doesn't work when the URL comes from stdin, because the
-	// pipe owns stdin. It is fine when a literal URL is passed to a flag.
-	if config.usesStdin() && config.hasIncompleteCredentials() {
-		return fmt.Errorf("interactive prompts don't work when reading the URL from stdin ('-'); provide credentials via flags or environment variables")
-	}
-
-	// Interactive prompts
-	if config.Username == "" {
-		username, err := promptForInput("Enter AWS SSO username: ", false)
-		if err != nil {
-			return err
+	// 2FA command: CLI -> ENV
+	if config.TwoFACmd == "" {
+		if env := os.Getenv("AWSSSOLOGIN_2FA_CMD"); env != "" {
+			config.TwoFACmd = env
+			log.Info("Using 2FA command from environment variable")
 		}
-		config.Username = username
+	} else {
+		log.Info("Using 2FA command from command line")
 	}
 
-	if config.Password == "" {
-		password, err := promptForInput("Enter AWS SSO password: ", true)
-		if err != nil {
-			return err
-		}
-		config.Password = password
+	// Config file identity: below flags, file descriptors and env vars.
+	if err := applyFileCredentials(ctx, config); err != nil {
+		return err
 	}
 
-	// If no 2FA code or TOTP secret provided, prompt for 2FA code later
-	// because we are limited in time for 2FA code
-	if config.TwoFA == "" && config.TOTPSecret == "" {
-		log.Info("No 2FA code or TOTP secret provided, will prompt for 2FA code later")
+	// A stored browser session usually skips the sign-in form; prompt only if
+	// the login steps find it.
+	if config.hasStoredSession() {
+		if config.hasIncompleteCredentials() {
+			log.Info("Stored browser session found; will prompt for credentials only if it has expired")
+		}
+		return nil
 	}
 
-	return nil
+	return config.promptForCredentials(ctx)
 }
 
-func promptForInput(prompt string, secure bool) (string, error) {
-	fmt.Print(prompt)
-
-	var input string
-	var err error
+// promptForCredentials prompts for the username and password if they are
+// still missing. The 2FA code is prompted for only when its field appears.
+func (c *Config) promptForCredentials(ctx context.Context) error {
+	// Interactive prompts read the controlling terminal (or pinentry), so they
+	// work even when the URL is piped in on stdin. Without a way to prompt
+	// (cron, CI) fail now rather than after the browser has started logging in.
+	if c.hasIncompleteCredentials() {
+		if err := checkPromptBackend(c); err != nil {
+			return fmt.Errorf("credentials are incomplete and interactive prompts are unavailable (%v); provide credentials via flags, file descriptors or environment variables", err)
+		}
+	}
 
-	if secure { // password input
-		bytes, err := term.ReadPassword(int(syscall.Stdin))
-		fmt.Println() // Add newline after password input
+	// Interactive prompts
+	if c.Username == "" {
+		username, err := promptForInput(ctx, c, "Enter AWS SSO username: ", false)
 		if err != nil {
-			return "", fmt.Errorf("failed to read secure input: %v", err)
+			return err
 		}
-		input = string(bytes)
-	} else { // plain text input
-		reader := bufio.NewReader(os.Stdin)
-		input, err = reader.ReadString('\n')
+		c.Username = username
+	}
+
+	if !c.Password.IsSet() {
+		password, err := promptForSecret(ctx, c, "Enter AWS SSO password: ", true)
 		if err != nil {
-			return "", fmt.Errorf("failed to read plain text input: %v", err)
+			return err
 		}
-		input = strings.TrimSpace(input)
+		c.Password = password
 	}
 
-	// if input is empty, return error
-	if input == "" {
-		return "", fmt.Errorf("input is empty")
+	// If no 2FA code, TOTP secret or 2FA command provided, prompt for 2FA code
+	// later because we are limited in time for 2FA code
+	if !c.TwoFA.IsSet() && !c.TOTPSecret.IsSet() && c.TwoFACmd == "" {
+		log.Info("No 2FA code, TOTP secret or 2FA command provided, will prompt for 2FA code later")
 	}
 
-	return input, nil
+	return nil
 }
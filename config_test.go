@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// pipeFD returns the read end of a pipe preloaded with data, as an inherited
+// descriptor would look to the process. It is a duplicate that readFD owns
+// and closes; the pipe's own descriptor is closed here.
+func pipeFD(t *testing.T, data string) int {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	defer r.Close()
+	return dupFD(t, r)
+}
+
+func TestGetCredentialsFromFDs(t *testing.T) {
+	for _, env := range []string{"AWSSSOLOGIN_USERNAME", "AWSSSOLOGIN_PASSWORD", "AWSSSOLOGIN_2FA", "AWSSSOLOGIN_TOTP_SECRET", "AWSSSOLOGIN_2FA_CMD"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWSSSOLOGIN_PASSWORD", "from-env")
+
+	config := &Config{
+		PasswordFD:    pipeFD(t, "from-fd\n"),
+		TOTPSecretFD:  -1,
+		CredentialsFD: pipeFD(t, `{"username": "alice", "password": "from-doc", "totp_secret": "JBSWY3DPEHPK3PXP"}`),
+	}
+	if err := getCredentials(t.Context(), config); err != nil {
+		t.Fatalf("getCredentials: %v", err)
+	}
+	if config.Username != "alice" || config.Password.Reveal() != "from-fd" || config.TOTPSecret.Reveal() != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("unexpected credentials: username=%q password=%q totp=%q", config.Username, config.Password.Reveal(), config.TOTPSecret.Reveal())
+	}
+
+	if _, err := readCredentialsFD(pipeFD(t, `{"pasword": "typo"}`)); err == nil {
+		t.Error("expected unknown JSON keys to be rejected")
+	}
+
+	config = &Config{Username: "alice", Password: NewSecret("argv"), TOTPSecret: NewSecret("JBSWY3DPEHPK3PXP"), PasswordFD: -1, TOTPSecretFD: -1, CredentialsFD: -1, ForbidArgvSecrets: true}
+	if err := getCredentials(t.Context(), config); err == nil {
+		t.Error("expected --forbid-argv-secrets to reject a password on argv")
+	}
+}
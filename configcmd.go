@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/spf13/cobra"
+)
+
+// Sources reported by `config show` for each setting.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFD      = "fd"
+	SourceFile    = "file"
+	SourceDefault = "default"
+	SourcePrompt  = "prompt"
+)
+
+// settingRow is one line of `config show`.
+type settingRow struct {
+	Name   string
+	Value  string
+	Source string
+	Detail string // which flag, variable, fd, file layer, ...
+}
+
+// newConfigCmd builds the `config` command with its `show` and `validate`
+// subcommands. They take the same flags as a login and merge them the same
+// way, but a URL source is optional.
+func newConfigCmd(config *Config) *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect and lint the merged configuration",
+	}
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:          "show",
+		Short:        "Print the effective configuration and where each value comes from",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.prepareSubcommand(cmd); err != nil {
+				return err
+			}
+			printSettings(config.effectiveSettings())
+			return nil
+		},
+	})
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:          "validate",
+		Short:        "Validate the configuration and resolve every credential reference",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.prepareSubcommand(cmd); err != nil {
+				return err
+			}
+			problems := config.lintSettingsFiles(cmd.Context())
+			for _, p := range problems {
+				fmt.Fprintln(os.Stderr, "✗ "+p)
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("%d configuration problem(s) found", len(problems))
+			}
+			fmt.Println("✓ configuration is valid")
+			return nil
+		},
+	})
+
+	return configCmd
+}
+
+// prepareSubcommand merges and validates the configuration the way a login
+// does, for subcommands that take the login flags but need no URL source.
+func (c *Config) prepareSubcommand(cmd *cobra.Command) error {
+	if err := c.applyLogLevel(); err != nil {
+		return err
+	}
+	c.flags = cmd.Flags()
+	c.allowNoURL = true
+	if err := c.ValidateConfig(); err != nil {
+		return fmt.Errorf("configuration validation failed: %v", err)
+	}
+	return nil
+}
+
+// printSettings writes rows as an aligned table.
+func printSettings(rows []settingRow) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE\tDETAIL")
+	for _, r := range rows {
+		value := r.Value
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, value, r.Source, r.Detail)
+	}
+	w.Flush()
+}
+
+// effectiveSettings lists the merged configuration with each value's source.
+// It must run after ValidateConfig and before getCredentials: credential
+// sources are worked out in getCredentials' order without reading file
+// descriptors, running commands or prompting, and secrets are redacted.
+func (c *Config) effectiveSettings() []settingRow {
+	id := c.fileIdentity
+	opts, _ := totpOpts(c.TOTP) // already validated
+
+	rows := []settingRow{
+		c.credentialRow("username", c.Username, "AWSSSOLOGIN_USERNAME", id.Username, func(id identity) bool { return id.Username != "" }),
+		c.secretRow("password", c.Password, "AWSSSOLOGIN_PASSWORD", c.PasswordFD, id.Password, func(id identity) bool { return id.Password != nil }),
+		c.secretRow("2fa", c.TwoFA, "AWSSSOLOGIN_2FA", -1, nil, nil),
+		c.secretRow("totp-secret", c.TOTPSecret, "AWSSSOLOGIN_TOTP_SECRET", c.TOTPSecretFD, id.TOTPSecret, func(id identity) bool { return id.TOTPSecret != nil }),
+		c.credentialRow("2fa-cmd", c.TwoFACmd, "AWSSSOLOGIN_2FA_CMD", id.TwoFACmd, func(id identity) bool { return id.TwoFACmd != "" }),
+		c.fileRow("timeout", strconv.Itoa(c.TimeoutSeconds), func(id identity) bool { return id.Timeout != 0 }),
+		c.fileRow("deadline", strconv.Itoa(c.DeadlineSeconds), func(id identity) bool { return id.Deadline != 0 }),
+		c.fileRow("show-browser", strconv.FormatBool(c.ShowBrowser), func(id identity) bool { return id.ShowBrowser != nil }),
+		c.fileRow("persist-session", strconv.FormatBool(c.PersistSession), func(id identity) bool { return id.PersistSession != nil }),
+		c.flagRow("fresh-session", strconv.FormatBool(c.FreshSession)),
+		c.browserRow("browser-bin", c.BrowserBin, EnvBrowserBin, func(id identity) bool { return id.BrowserBin != "" }),
+		c.fileRow("browser-flag", strings.Join(c.BrowserFlags, " "), func(id identity) bool { return id.BrowserFlags != nil }),
+		c.fileRow("block-requests", strconv.FormatBool(c.BlockRequests), func(id identity) bool { return id.BlockRequests != nil }),
+		c.fileRow("relay-callback", strconv.FormatBool(c.relaysCallback()), func(id identity) bool { return id.RelayCallback != nil }),
+		c.fileRow("dex-connector", c.DexConnector, func(id identity) bool { return id.DexConnector != "" }),
+		c.fileRow("dex-approve-client", strings.Join(c.DexApproveClients, " "), func(id identity) bool { return id.DexApprove != nil }),
+		c.proxyRow(),
+		c.fileRow("proxy-pac", c.ProxyPAC, func(id identity) bool { return id.ProxyPAC != "" }),
+		c.fileRow("proxy-user", c.ProxyUser, func(id identity) bool { return id.ProxyUser != "" }),
+		c.fileRow("ca-file", c.CAFile, func(id identity) bool { return id.CAFile != "" }),
+		c.browserRow("offline", strconv.FormatBool(c.Offline), EnvOffline, func(id identity) bool { return id.Offline != nil }),
+		c.fileRow("debug-dir", c.DebugDir, func(id identity) bool { return id.DebugDir != "" }),
+		c.fileRow("log-level", c.LogLevel, func(id identity) bool { return id.LogLevel != "" }),
+		c.fileRow("totp.digits", strconv.Itoa(opts.Digits.Length()), func(id identity) bool { return id.TOTP.Digits != 0 }),
+		c.fileRow("totp.period", strconv.FormatUint(uint64(opts.Period), 10), func(id identity) bool { return id.TOTP.Period != 0 }),
+		c.fileRow("totp.algorithm", opts.Algorithm.String(), func(id identity) bool { return id.TOTP.Algorithm != "" }),
+		c.flagRow("2fa-cmd-timeout", strconv.Itoa(c.TwoFACmdTimeoutSeconds)),
+		c.flagRow("prompt-backend", c.PromptBackend),
+		c.flagRow("pinentry-program", c.PinentryProgram),
+		c.flagRow("device-url", c.DeviceURL),
+		c.flagRow(c.authCodeFlag(), c.DexURL),
+		c.envRow("config", c.filePath, "AWSSSOLOGIN_CONFIG"),
+		c.envRow("identity", c.identityName, "AWSSSOLOGIN_IDENTITY"),
+		c.flagRow("sso-session", c.SSOSession),
+	}
+
+	// Selection that didn't come from a flag or env var came from matching.
+	for i := range rows {
+		switch rows[i].Name {
+		case "identity":
+			if rows[i].Value != "" && rows[i].Source == SourceDefault {
+				rows[i].Source, rows[i].Detail = SourceFile, "matched"
+				if c.awsSession != nil && c.awsSession.Identity == c.identityName {
+					rows[i].Detail = "aws-config sso-session " + c.awsSession.Name
+				}
+			}
+		case "2fa-cmd":
+			if rows[i].Source == SourcePrompt {
+				rows[i].Source = SourceDefault // optional, never prompted for
+			}
+		case "sso-session":
+			if rows[i].Value != "" && rows[i].Source == SourceDefault && c.awsSession != nil {
+				rows[i].Source, rows[i].Detail = SourceFile, "aws-config start URL match"
+			}
+		}
+	}
+	return rows
+}
+
+// flagRow reports a setting that only a flag can change.
+func (c *Config) flagRow(name, value string) settingRow {
+	if c.flagChanged(name) {
+		return settingRow{Name: name, Value: value, Source: SourceFlag, Detail: "--" + name}
+	}
+	return settingRow{Name: name, Value: value, Source: SourceDefault}
+}
+
+// envRow reports a setting that a flag or an environment variable can set.
+func (c *Config) envRow(name, value, env string) settingRow {
+	row := c.flagRow(name, value)
+	if row.Source == SourceDefault && os.Getenv(env) != "" {
+		row.Source, row.Detail = SourceEnv, env
+	}
+	return row
+}
+
+// fileRow reports a setting that a flag or the settings files can set.
+func (c *Config) fileRow(name, value string, has func(identity) bool) settingRow {
+	row := c.flagRow(name, value)
+	if row.Source == SourceDefault {
+		if layer := c.fileLayer(has); layer != "" {
+			row.Source, row.Detail = SourceFile, layer
+		}
+	}
+	return row
+}
+
+// browserRow reports a setting that a flag, an environment variable or the
+// settings files can set, in that order.
+func (c *Config) browserRow(name, value, env string, has func(identity) bool) settingRow {
+	row := c.envRow(name, value, env)
+	if row.Source == SourceDefault {
+		if layer := c.fileLayer(has); layer != "" {
+			row.Source, row.Detail = SourceFile, layer
+		}
+	}
+	return row
+}
+
+// proxyRow reports the proxy, which may also come from the standard proxy
+// variables. A password in the proxy URL is redacted.
+func (c *Config) proxyRow() settingRow {
+	value := c.Proxy
+	if value == "" && c.ProxyPAC == "" {
+		for _, env := range proxyEnvVars {
+			if v := os.Getenv(env); v != "" {
+				value = v
+				break
+			}
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		value = u.Redacted()
+	}
+
+	row := c.fileRow("proxy", value, func(id identity) bool { return id.Proxy != "" })
+	if row.Source == SourceDefault && value != "" {
+		for _, env := range proxyEnvVars {
+			if os.Getenv(env) != "" {
+				row.Source, row.Detail = SourceEnv, env
+				break
+			}
+		}
+	}
+	return row
+}
+
+// credentialRow reports a plain credential: flag, credentials fd, env, file.
+func (c *Config) credentialRow(name, value, env, fileValue string, has func(identity) bool) settingRow {
+	switch {
+	case value != "":
+		return settingRow{Name: name, Value: value, Source: SourceFlag, Detail: "--" + name}
+	case c.CredentialsFD >= 0 && name == "username":
+		return settingRow{Name: name, Source: SourceFD, Detail: fmt.Sprintf("credentials fd %d, if present", c.CredentialsFD)}
+	case os.Getenv(env) != "":
+		return settingRow{Name: name, Value: os.Getenv(env), Source: SourceEnv, Detail: env}
+	case fileValue != "":
+		return settingRow{Name: name, Value: fileValue, Source: SourceFile, Detail: c.fileLayer(has)}
+	}
+	return settingRow{Name: name, Source: SourcePrompt}
+}
+
+// secretRow reports a secret credential with its value redacted.
+func (c *Config) secretRow(name string, value Secret, env string, fd int, ref *credentialRef, has func(identity) bool) settingRow {
+	row := settingRow{Name: name, Value: value.String()}
+	switch {
+	case value.IsSet():
+		row.Source, row.Detail = SourceFlag, "--"+name
+	case fd >= 0:
+		row.Source, row.Detail = SourceFD, fmt.Sprintf("fd %d", fd)
+	case c.CredentialsFD >= 0:
+		row.Source, row.Detail = SourceFD, fmt.Sprintf("credentials fd %d, if present", c.CredentialsFD)
+	case os.Getenv(env) != "":
+		row.Value, row.Source, row.Detail = redacted, SourceEnv, env
+	case ref != nil:
+		row.Value, row.Source, row.Detail = redacted, SourceFile, c.fileLayer(has)+": "+ref.describe()
+	default:
+		row.Source = SourcePrompt
+	}
+	return row
+}
+
+// fileLayer names the most specific settings-file layer where has is true:
+// the ~/.aws/config sso-session, the identity, or the config file defaults.
+func (c *Config) fileLayer(has func(identity) bool) string {
+	switch {
+	case c.awsSession != nil && has(c.awsSession.Settings):
+		return "aws-config sso-session " + c.awsSession.Name
+	case c.file != nil && c.identityName != "" && has(c.file.Identities[c.identityName]):
+		return "identity " + c.identityName
+	case c.file != nil && has(c.file.Defaults):
+		return "defaults"
+	}
+	return ""
+}
+
+// lintSettingsFiles resolves every credential reference of every identity in
+// the config file, without using it, and checks that each TOTP secret yields a
+// code with that identity's TOTP parameters. It returns one message per
+// problem. Parsing and value validation already happened in ValidateConfig.
+func (c *Config) lintSettingsFiles(ctx context.Context) []string {
+	if c.file == nil {
+		return nil
+	}
+
+	var problems []string
+	check := func(where string, id identity) {
+		if id.Password != nil {
+			secret, err := id.Password.resolve(ctx)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: password (%s): %v", where, id.Password.describe(), err))
+			}
+			secret.Wipe()
+		}
+		if id.TOTPSecret != nil {
+			secret, err := id.TOTPSecret.resolve(ctx)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: totp_secret (%s): %v", where, id.TOTPSecret.describe(), err))
+			} else if opts, err := totpOpts(id.TOTP); err == nil {
+				if _, err := totp.GenerateCodeCustom(secret.Reveal(), time.Now(), opts); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: totp_secret (%s): not a valid TOTP secret: %v", where, id.TOTPSecret.describe(), err))
+				}
+			}
+			secret.Wipe()
+		}
+	}
+
+	check("defaults", c.file.Defaults)
+	for _, name := range c.file.identityNames() {
+		check(fmt.Sprintf("identity %q", name), c.file.Identities[name].over(c.file.Defaults))
+	}
+	for _, s := range c.awsSessions {
+		if s.Identity != "" {
+			if _, ok := c.file.Identities[s.Identity]; !ok {
+				problems = append(problems, fmt.Sprintf("aws-config sso-session %s: awsssologin_identity %q is not defined in the config file", s.Name, s.Identity))
+			}
+		}
+	}
+	return problems
+}
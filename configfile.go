@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+)
+
+// CredentialCmdTimeout bounds a single `cmd:` credential reference run.
+const CredentialCmdTimeout = 60 * time.Second
+
+// configFile is the YAML config file (~/.config/awsssologin/config.yaml). It
+// holds named identities, each with the settings for the sessions it is
+// matched to, plus defaults shared by every identity. Its values sit below
+// flags and environment variables.
+type configFile struct {
+	Defaults   identity            `yaml:"defaults"`
+	Identities map[string]identity `yaml:"identities"`
+}
+
+// identity is one named set of credentials and settings. Zero values mean
+// "not set here".
+type identity struct {
+	Username       string         `yaml:"username"`
+	Password       *credentialRef `yaml:"password"`
+	TOTPSecret     *credentialRef `yaml:"totp_secret"`
+	TwoFACmd       string         `yaml:"2fa_cmd"`
+	TOTP           totpParams     `yaml:"totp"`
+	Timeout        int            `yaml:"timeout"`
+	Deadline       int            `yaml:"deadline"`
+	ShowBrowser    *bool          `yaml:"show_browser"`
+	PersistSession *bool          `yaml:"persist_session"`
+	BrowserBin     string         `yaml:"browser_bin"`
+	BrowserFlags   []string       `yaml:"browser_flags"`
+	Offline        *bool          `yaml:"offline"`
+	BlockRequests  *bool          `yaml:"block_requests"`
+	RelayCallback  *bool          `yaml:"relay_callback"`
+	DexConnector   string         `yaml:"dex_connector"`
+	DexApprove     []string       `yaml:"dex_approve_clients"`
+	Proxy          string         `yaml:"proxy"`
+	ProxyPAC       string         `yaml:"proxy_pac"`
+	ProxyUser      string         `yaml:"proxy_user"`
+	CAFile         string         `yaml:"ca_file"`
+	DebugDir       string         `yaml:"debug_dir"`
+	LogLevel       string         `yaml:"log_level"`
+	Match          identityMatch  `yaml:"match"`
+}
+
+// totpParams are the TOTP generation parameters; zero means the standard
+// (6 digits, 30 s period, SHA1).
+type totpParams struct {
+	Digits    int    `yaml:"digits"`
+	Period    uint   `yaml:"period"`
+	Algorithm string `yaml:"algorithm"`
+}
+
+// identityMatch lists what selects an identity when --identity isn't given.
+type identityMatch struct {
+	SSOSessions []string `yaml:"sso_sessions"`
+	StartURLs   []string `yaml:"start_urls"`
+	Hosts       []string `yaml:"hosts"`
+}
+
+// credentialRef says where a secret comes from. Exactly one field is set.
+type credentialRef struct {
+	Value string `yaml:"value"`
+	Env   string `yaml:"env"`
+	File  string `yaml:"file"`
+	Cmd   string `yaml:"cmd"`
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/awsssologin/config.yaml, falling
+// back to ~/.config on every OS so the documented path is the real one.
+func defaultConfigPath() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "awsssologin", "config.yaml"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "awsssologin", "config.yaml"), nil
+}
+
+// expandHome expands a leading "~/" to the user's home directory.
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// readConfigFile parses and validates a config file. Unknown keys are
+// rejected so typos don't silently drop a setting.
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid YAML: %v", err)
+	}
+
+	if err := f.Defaults.validate(); err != nil {
+		return nil, fmt.Errorf("defaults: %v", err)
+	}
+	for _, name := range f.identityNames() {
+		if err := f.Identities[name].validate(); err != nil {
+			return nil, fmt.Errorf("identity %q: %v", name, err)
+		}
+	}
+	return &f, nil
+}
+
+// identityNames returns the identity names in a stable order.
+func (f *configFile) identityNames() []string {
+	names := make([]string, 0, len(f.Identities))
+	for name := range f.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks an identity's values without resolving its credentials.
+func (id identity) validate() error {
+	if id.Timeout < 0 {
+		return fmt.Errorf("timeout must be at least 1 second, got: %d", id.Timeout)
+	}
+	if id.Deadline < 0 {
+		return fmt.Errorf("deadline must be a number of seconds, got: %d", id.Deadline)
+	}
+	if id.LogLevel != "" {
+		if _, err := log.ParseLevel(id.LogLevel); err != nil {
+			return fmt.Errorf("invalid log_level: %v", err)
+		}
+	}
+	if _, err := totpOpts(id.TOTP); err != nil {
+		return fmt.Errorf("totp: %v", err)
+	}
+	for _, f := range id.BrowserFlags {
+		if _, _, _, err := parseBrowserFlag(f); err != nil {
+			return fmt.Errorf("browser_flags: %v", err)
+		}
+	}
+	for field, ref := range map[string]*credentialRef{"password": id.Password, "totp_secret": id.TOTPSecret} {
+		if ref == nil {
+			continue
+		}
+		if err := ref.validate(); err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// over returns id with every unset value taken from base.
+func (id identity) over(base identity) identity {
+	if id.Username == "" {
+		id.Username = base.Username
+	}
+	if id.Password == nil {
+		id.Password = base.Password
+	}
+	if id.TOTPSecret == nil {
+		id.TOTPSecret = base.TOTPSecret
+	}
+	if id.TwoFACmd == "" {
+		id.TwoFACmd = base.TwoFACmd
+	}
+	if id.TOTP.Digits == 0 {
+		id.TOTP.Digits = base.TOTP.Digits
+	}
+	if id.TOTP.Period == 0 {
+		id.TOTP.Period = base.TOTP.Period
+	}
+	if id.TOTP.Algorithm == "" {
+		id.TOTP.Algorithm = base.TOTP.Algorithm
+	}
+	if id.Timeout == 0 {
+		id.Timeout = base.Timeout
+	}
+	if id.Deadline == 0 {
+		id.Deadline = base.Deadline
+	}
+	if id.ShowBrowser == nil {
+		id.ShowBrowser = base.ShowBrowser
+	}
+	if id.PersistSession == nil {
+		id.PersistSession = base.PersistSession
+	}
+	if id.BrowserBin == "" {
+		id.BrowserBin = base.BrowserBin
+	}
+	if id.BrowserFlags == nil {
+		id.BrowserFlags = base.BrowserFlags
+	}
+	if id.Offline == nil {
+		id.Offline = base.Offline
+	}
+	if id.BlockRequests == nil {
+		id.BlockRequests = base.BlockRequests
+	}
+	if id.RelayCallback == nil {
+		id.RelayCallback = base.RelayCallback
+	}
+	if id.DexConnector == "" {
+		id.DexConnector = base.DexConnector
+	}
+	if id.DexApprove == nil {
+		id.DexApprove = base.DexApprove
+	}
+	if id.Proxy == "" {
+		id.Proxy = base.Proxy
+	}
+	if id.ProxyPAC == "" {
+		id.ProxyPAC = base.ProxyPAC
+	}
+	if id.ProxyUser == "" {
+		id.ProxyUser = base.ProxyUser
+	}
+	if id.CAFile == "" {
+		id.CAFile = base.CAFile
+	}
+	if id.DebugDir == "" {
+		id.DebugDir = base.DebugDir
+	}
+	if id.LogLevel == "" {
+		id.LogLevel = base.LogLevel
+	}
+	return id
+}
+
+// selectIdentity picks the identity for this run: the explicit name if
+// given, else the one matching the sso-session, else the one whose start URL
+// prefixes loginURL, else the one matching loginURL's host. It returns "" if
+// nothing matches, and an error if a match is ambiguous.
+func (f *configFile) selectIdentity(name, ssoSession, loginURL string) (string, error) {
+	if name != "" {
+		if _, ok := f.Identities[name]; !ok {
+			return "", fmt.Errorf("identity %q is not defined in the config file", name)
+		}
+		return name, nil
+	}
+
+	host := urlHost(loginURL)
+	matchers := []struct {
+		by    string
+		match func(identityMatch) bool
+	}{
+		{"sso-session", func(m identityMatch) bool {
+			return ssoSession != "" && slices.Contains(m.SSOSessions, ssoSession)
+		}},
+		{"start URL", func(m identityMatch) bool {
+			return loginURL != "" && slices.ContainsFunc(m.StartURLs, func(u string) bool {
+				return strings.HasPrefix(loginURL, strings.TrimSuffix(u, "/"))
+			})
+		}},
+		{"host", func(m identityMatch) bool {
+			return host != "" && slices.ContainsFunc(m.Hosts, func(h string) bool {
+				return strings.EqualFold(h, host)
+			})
+		}},
+	}
+
+	for _, m := range matchers {
+		var found []string
+		for _, n := range f.identityNames() {
+			if m.match(f.Identities[n].Match) {
+				found = append(found, n)
+			}
+		}
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			log.Info("Selected identity from config file", "identity", found[0], "by", m.by)
+			return found[0], nil
+		default:
+			return "", fmt.Errorf("%s matches several identities (%s); pass --identity", m.by, strings.Join(found, ", "))
+		}
+	}
+	return "", nil
+}
+
+// loadSettingsFiles reads the config file and ~/.aws/config once, then
+// selects and applies their settings as far as they can already be chosen
+// (explicit --identity or --sso-session, or a literal URL). With the URL on
+// stdin, URL-based matching is finished by applyURLSettings.
+func (c *Config) loadSettingsFiles() error {
+	if c.settingsLoaded {
+		return nil
+	}
+	c.settingsLoaded = true
+
+	if c.Identity == "" {
+		if env := os.Getenv("AWSSSOLOGIN_IDENTITY"); env != "" {
+			c.Identity = env
+		}
+	}
+	if err := c.applyBrowserEnv(); err != nil {
+		return err
+	}
+	if err := c.loadConfigFile(); err != nil {
+		return err
+	}
+	if err := c.loadAWSConfig(); err != nil {
+		return err
+	}
+	return c.selectSettings(c.literalURL())
+}
+
+// loadConfigFile reads the config file. A missing default config file is
+// fine; a missing --config file is not.
+func (c *Config) loadConfigFile() error {
+	path := c.ConfigFile
+	if path == "" {
+		path = os.Getenv("AWSSSOLOGIN_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			log.Debug("Could not locate the default config file", "error", err)
+			return nil
+		}
+	}
+
+	f, err := readConfigFile(expandHome(path))
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		log.Debug("No config file", "path", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	log.Debug("Loaded config file", "path", path)
+	c.file = f
+	c.filePath = path
+	return nil
+}
+
+// literalURL returns the login URL given on the command line, or "" when it
+// is read from stdin.
+func (c *Config) literalURL() string {
+	for _, u := range []string{c.DexURL, c.DeviceURL} {
+		if u != "" && u != StdinURLSource {
+			return u
+		}
+	}
+	return ""
+}
+
+// applyURLSettings finishes selecting the ~/.aws/config sso-session and the
+// config file identity by the login URL once it has been read from stdin.
+func (c *Config) applyURLSettings(loginURL string) error {
+	return c.selectSettings(loginURL)
+}
+
+// selectSettings picks whichever of the ~/.aws/config sso-session and the
+// config file identity isn't chosen yet, then applies the merged settings.
+// The sso-session comes first: it may name the identity
+// (awsssologin_identity) and it feeds the identity's sso_sessions match.
+func (c *Config) selectSettings(loginURL string) error {
+	if c.awsSession == nil {
+		if session := matchAWSSSOSession(c.awsSessions, c.SSOSession, loginURL); session != nil {
+			log.Info("Using settings from AWS config", "ssoSession", session.Name)
+			c.awsSession = session
+			if c.SSOSession == "" {
+				c.SSOSession = session.Name
+			}
+		}
+	}
+
+	if c.identityName == "" {
+		name := c.Identity
+		if name == "" && c.awsSession != nil {
+			name = c.awsSession.Identity
+		}
+		switch {
+		case c.file != nil:
+			selected, err := c.file.selectIdentity(name, c.SSOSession, loginURL)
+			if err != nil {
+				return err
+			}
+			c.identityName = selected
+		case name != "":
+			return fmt.Errorf("identity %q was requested but there is no config file", name)
+		}
+	}
+
+	c.applyFileSettings()
+	return c.applyLogLevel()
+}
+
+// applyFileSettings merges, from lowest to highest, the config file defaults,
+// the selected identity, and the ~/.aws/config sso-session keys into the
+// config. Settings whose flag was given on the command line are left alone;
+// credentials are kept aside for getCredentials, where they rank below file
+// descriptors and env vars.
+func (c *Config) applyFileSettings() {
+	var id identity
+	if c.file != nil {
+		id = c.file.Defaults
+		if c.identityName != "" {
+			id = c.file.Identities[c.identityName].over(id)
+		}
+	}
+	if c.awsSession != nil {
+		id = c.awsSession.Settings.over(id)
+	}
+	c.fileIdentity = id
+
+	if id.Timeout != 0 && !c.flagChanged("timeout") {
+		c.TimeoutSeconds = id.Timeout
+	}
+	if id.Deadline != 0 && !c.flagChanged("deadline") {
+		c.DeadlineSeconds = id.Deadline
+	}
+	if id.ShowBrowser != nil && !c.flagChanged("show-browser") {
+		c.ShowBrowser = *id.ShowBrowser
+	}
+	if id.PersistSession != nil && !c.flagChanged("persist-session") {
+		c.PersistSession = *id.PersistSession
+	}
+	if id.BrowserBin != "" && !c.flagChanged("browser-bin") && os.Getenv(EnvBrowserBin) == "" {
+		c.BrowserBin = id.BrowserBin
+	}
+	if id.BrowserFlags != nil && !c.flagChanged("browser-flag") {
+		c.BrowserFlags = id.BrowserFlags
+	}
+	if id.Offline != nil && !c.flagChanged("offline") && os.Getenv(EnvOffline) == "" {
+		c.Offline = *id.Offline
+	}
+	if id.BlockRequests != nil && !c.flagChanged("block-requests") {
+		c.BlockRequests = *id.BlockRequests
+	}
+	if id.RelayCallback != nil && !c.flagChanged("relay-callback") {
+		c.RelayCallback = *id.RelayCallback
+	}
+	if id.DexConnector != "" && !c.flagChanged("dex-connector") {
+		c.DexConnector = id.DexConnector
+	}
+	if id.DexApprove != nil && !c.flagChanged("dex-approve-client") {
+		c.DexApproveClients = id.DexApprove
+	}
+	// A proxy and a PAC file exclude each other, so either flag overrides
+	// both settings.
+	if !c.flagChanged("proxy") && !c.flagChanged("proxy-pac") {
+		if id.Proxy != "" {
+			c.Proxy = id.Proxy
+		}
+		if id.ProxyPAC != "" {
+			c.ProxyPAC = id.ProxyPAC
+		}
+	}
+	if id.ProxyUser != "" && !c.flagChanged("proxy-user") {
+		c.ProxyUser = id.ProxyUser
+	}
+	if id.CAFile != "" && !c.flagChanged("ca-file") {
+		c.CAFile = expandHome(id.CAFile)
+	}
+	if id.DebugDir != "" && !c.flagChanged("debug-dir") {
+		c.DebugDir = expandHome(id.DebugDir)
+	}
+	if id.LogLevel != "" && !c.flagChanged("log-level") {
+		c.LogLevel = id.LogLevel
+	}
+	c.TOTP = id.TOTP
+}
+
+// flagChanged reports whether the named flag was given on the command line.
+func (c *Config) flagChanged(name string) bool {
+	return c.flags != nil && c.flags.Changed(name)
+}
+
+// applyFileCredentials fills credentials still missing after flags, file
+// descriptors and env vars from the config file identity and AWS config.
+func applyFileCredentials(ctx context.Context, config *Config) error {
+	id := config.fileIdentity
+	source := "config file"
+	if config.identityName != "" {
+		source = fmt.Sprintf("config file identity %q", config.identityName)
+	}
+
+	if config.Username == "" && id.Username != "" {
+		config.Username = id.Username
+		log.Info("Using username from "+source, "username", config.Username)
+	}
+
+	if !config.Password.IsSet() && id.Password != nil {
+		password, err := id.Password.resolve(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to resolve password from %s: %v", source, err)
+		}
+		config.Password = password
+		log.Info("Using password from "+source, "ref", id.Password.describe())
+	}
+
+	if !config.TwoFA.IsSet() && !config.TOTPSecret.IsSet() && id.TOTPSecret != nil {
+		secret, err := id.TOTPSecret.resolve(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to resolve TOTP secret from %s: %v", source, err)
+		}
+		config.TOTPSecret = secret
+		log.Info("Using TOTP secret from "+source, "ref", id.TOTPSecret.describe())
+	}
+
+	if config.TwoFACmd == "" && id.TwoFACmd != "" {
+		config.TwoFACmd = id.TwoFACmd
+		log.Info("Using 2FA command from " + source)
+	}
+
+	return nil
+}
+
+// validate checks that exactly one source is set.
+func (r *credentialRef) validate() error {
+	set := 0
+	for _, v := range []string{r.Value, r.Env, r.File, r.Cmd} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of value, env, file or cmd must be set")
+	}
+	return nil
+}
+
+// describe names the source without revealing the secret.
+func (r *credentialRef) describe() string {
+	switch {
+	case r.Env != "":
+		return "env " + r.Env
+	case r.File != "":
+		return "file " + r.File
+	case r.Cmd != "":
+		return "cmd " + r.Cmd
+	default:
+		return "inline value"
+	}
+}
+
+// resolve fetches the secret from its source. A command is killed when ctx
+// is done.
+func (r *credentialRef) resolve(ctx context.Context) (Secret, error) {
+	switch {
+	case r.Env != "":
+		v := os.Getenv(r.Env)
+		if v == "" {
+			return Secret{}, fmt.Errorf("environment variable %s is not set", r.Env)
+		}
+		return NewSecret(v), nil
+	case r.File != "":
+		data, err := os.ReadFile(expandHome(r.File))
+		if err != nil {
+			return Secret{}, err
+		}
+		return nonEmptySecret(data, "file "+r.File)
+	case r.Cmd != "":
+		ctx, cancel := context.WithTimeout(ctx, CredentialCmdTimeout)
+		defer cancel()
+		var stdout bytes.Buffer
+		cmd := shellCommand(ctx, r.Cmd)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return Secret{}, fmt.Errorf("command failed: %v", err)
+		}
+		return nonEmptySecret(stdout.Bytes(), "command output")
+	default:
+		return NewSecret(r.Value), nil
+	}
+}
+
+// nonEmptySecret trims trailing whitespace from data into a Secret, clearing
+// data, and fails if nothing is left.
+func nonEmptySecret(data []byte, what string) (Secret, error) {
+	secret := secretFromBytes(bytes.TrimRight(data, " \t\r\n"))
+	clear(data)
+	if !secret.IsSet() {
+		return Secret{}, fmt.Errorf("%s is empty", what)
+	}
+	return secret, nil
+}
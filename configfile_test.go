@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const testConfigFile = `
+defaults:
+  timeout: 45
+  log_level: info
+identities:
+  corp:
+    username: alice@corp.example.com
+    password: {env: TEST_CORP_PASSWORD}
+    totp_secret: {value: JBSWY3DPEHPK3PXP}
+    totp: {digits: 8, algorithm: sha256}
+    show_browser: true
+    match:
+      start_urls: [https://corp.awsapps.com/start]
+  lab:
+    username: bob@lab.example.com
+    timeout: 90
+    match:
+      sso_sessions: [lab]
+      hosts: [argocd.lab.example.com]
+`
+
+// TestConfigFileIdentity checks identity selection and that file values sit
+// below flags and env vars but above built-in defaults.
+func TestConfigFileIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfigFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"AWSSSOLOGIN_USERNAME", "AWSSSOLOGIN_PASSWORD", "AWSSSOLOGIN_2FA", "AWSSSOLOGIN_TOTP_SECRET", "AWSSSOLOGIN_2FA_CMD", "AWSSSOLOGIN_IDENTITY"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("TEST_CORP_PASSWORD", "corp-password")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	newConfig := testConfigWithFlags(t, path)
+
+	// Matched by start URL; the --timeout flag beats the file's default.
+	c := newConfig("--device-url", "https://corp.awsapps.com/start/#/device?user_code=ABCD-1234", "--timeout", "10")
+	if err := c.ValidateConfig(); err != nil {
+		t.Fatalf("ValidateConfig: %v", err)
+	}
+	if c.identityName != "corp" || c.TimeoutSeconds != 10 || !c.ShowBrowser || c.TOTP.Digits != 8 {
+		t.Errorf("unexpected merge: identity=%q timeout=%d show=%t totp=%+v", c.identityName, c.TimeoutSeconds, c.ShowBrowser, c.TOTP)
+	}
+	sources := map[string]string{}
+	for _, row := range c.effectiveSettings() {
+		sources[row.Name] = row.Source + " " + row.Detail
+	}
+	for name, want := range map[string]string{
+		"timeout":     "flag --timeout",
+		"password":    "file identity corp: env TEST_CORP_PASSWORD",
+		"log-level":   "file defaults",
+		"totp.digits": "file identity corp",
+	} {
+		if sources[name] != want {
+			t.Errorf("source of %s = %q, want %q", name, sources[name], want)
+		}
+	}
+	if err := getCredentials(t.Context(), c); err != nil {
+		t.Fatalf("getCredentials: %v", err)
+	}
+	if c.Username != "alice@corp.example.com" || c.Password.Reveal() != "corp-password" || c.TOTPSecret.Reveal() != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("unexpected credentials: username=%q", c.Username)
+	}
+
+	// URL on stdin: nothing selected up front, then matched by host.
+	c = newConfig("--device-url", "-")
+	if err := c.ValidateConfig(); err != nil {
+		t.Fatalf("ValidateConfig: %v", err)
+	}
+	if c.identityName != "" || c.TimeoutSeconds != 45 {
+		t.Errorf("expected only defaults before the URL is known, got identity=%q timeout=%d", c.identityName, c.TimeoutSeconds)
+	}
+	if err := c.applyURLSettings("https://argocd.lab.example.com/api/dex/auth?redirect_uri=http://localhost:8085/auth/callback"); err != nil {
+		t.Fatal(err)
+	}
+	if c.identityName != "lab" || c.TimeoutSeconds != 90 {
+		t.Errorf("expected lab identity by host, got identity=%q timeout=%d", c.identityName, c.TimeoutSeconds)
+	}
+
+	// Env var beats the file for credentials.
+	t.Setenv("AWSSSOLOGIN_USERNAME", "env-user")
+	c = newConfig("--device-url", "-", "--sso-session", "lab")
+	if err := c.ValidateConfig(); err != nil {
+		t.Fatalf("ValidateConfig: %v", err)
+	}
+	c.Password = NewSecret("x")
+	c.TwoFA = NewSecret("123456")
+	if err := getCredentials(t.Context(), c); err != nil {
+		t.Fatalf("getCredentials: %v", err)
+	}
+	if c.identityName != "lab" || c.Username != "env-user" {
+		t.Errorf("expected env username over lab identity, got identity=%q username=%q", c.identityName, c.Username)
+	}
+
+	if err := newConfig("--device-url", "-", "--identity", "missing").ValidateConfig(); err == nil {
+		t.Error("expected an error for an undefined identity")
+	}
+
+	// A cancelled run doesn't wait out a hanging cmd reference.
+	if runtime.GOOS != "windows" {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		if _, err := (&credentialRef{Cmd: "sleep 30"}).resolve(ctx); err == nil || time.Since(start) > 10*time.Second {
+			t.Errorf("cmd reference on a cancelled run = %v after %s", err, time.Since(start))
+		}
+	}
+}
+
+// testConfigWithFlags returns a constructor for configs parsed from args,
+// using the config file at path, the way main wires them up.
+func testConfigWithFlags(t *testing.T, path string) func(args ...string) *Config {
+	return func(args ...string) *Config {
+		c := &Config{PromptBackend: PromptBackendTTY, PasswordFD: -1, TOTPSecretFD: -1, CredentialsFD: -1, TwoFACmdTimeoutSeconds: 1}
+		c.flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+		c.flags.IntVar(&c.TimeoutSeconds, "timeout", DefaultTimeout, "")
+		c.flags.BoolVar(&c.ShowBrowser, "show-browser", false, "")
+		c.flags.StringVar(&c.LogLevel, "log-level", "info", "")
+		c.flags.StringVar(&c.DeviceURL, "device-url", "", "")
+		c.flags.StringVar(&c.Identity, "identity", "", "")
+		c.flags.StringVar(&c.SSOSession, "sso-session", "", "")
+		if err := c.flags.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		c.ConfigFile = path
+		return c
+	}
+}
+
+// TestAWSConfigSession checks that awsssologin_* keys in the matching
+// [sso-session] of ~/.aws/config pick the identity and override its values.
+func TestAWSConfigSession(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfigFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	awsConfig := filepath.Join(dir, "aws-config")
+	if err := os.WriteFile(awsConfig, []byte(`
+[profile dev]
+sso_session = corp
+awsssologin_timeout = ignored-outside-sso-session-sections
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start/#
+sso_registration_scopes = sso:account:access
+awsssologin_identity = lab
+awsssologin_timeout = 60
+awsssologin_from_the_future = yes
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", awsConfig)
+	t.Setenv("AWSSSOLOGIN_IDENTITY", "")
+
+	c := testConfigWithFlags(t, path)("--device-url", "https://corp.awsapps.com/start/#/device?user_code=ABCD-1234")
+	if err := c.ValidateConfig(); err != nil {
+		t.Fatalf("ValidateConfig: %v", err)
+	}
+	if c.SSOSession != "corp" || c.identityName != "lab" || c.TimeoutSeconds != 60 || c.fileIdentity.Username != "bob@lab.example.com" {
+		t.Errorf("unexpected settings: session=%q identity=%q timeout=%d username=%q", c.SSOSession, c.identityName, c.TimeoutSeconds, c.fileIdentity.Username)
+	}
+}
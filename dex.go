@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+const (
+	// XPathDexConnector matches the links of Dex's "Log in with..." chooser,
+	// shown when Dex has more than one connector. Each link's href ends in
+	// /auth/<connector id>.
+	XPathDexConnector = `//a[button[contains(@class, "theme-btn-provider")]]`
+	// XPathDexLogin and XPathDexPassword match the fields of the login form
+	// of Dex's password connectors: its static passwords, LDAP and the like.
+	XPathDexLogin    = `//form//input[@id="login" and @name="login"]`
+	XPathDexPassword = `//form//input[@id="password" and @name="password"]`
+	// XPathDexLoginError matches the error Dex shows on that form when the
+	// credentials are rejected.
+	XPathDexLoginError = `//*[@id="login-error"]`
+	// XPathDexApprove matches the "Grant Access" button of Dex's approval
+	// screen, shown for clients without skipApprovalScreen.
+	XPathDexApprove = `//form[.//input[@name="approval" and @value="approve"]]//button[@type="submit"]`
+)
+
+// dexWait is w.wait for the Dex flow: it also watches for the connector
+// chooser and the approval screen, handles whichever shows up, and goes on
+// waiting for checks.
+func dexWait(w *pageWatch, config *Config, timeout time.Duration, what string, checks ...pageCheck) (int, error) {
+	chooser, approval := len(checks), len(checks)+1
+	checks = append(checks, hasX(XPathDexConnector), hasX(XPathDexApprove))
+	for {
+		first, err := w.wait(timeout, what, checks...)
+		if err != nil {
+			return first, err
+		}
+		switch first {
+		case chooser:
+			err = chooseDexConnector(w, config, timeout)
+		case approval:
+			err = approveDexClient(w, config, timeout)
+		default:
+			return first, nil
+		}
+		if err != nil {
+			return first, err
+		}
+	}
+}
+
+// performDexPasswordSteps signs in on the login form of a Dex password
+// connector, then waits for the callback like performDexAuthSteps. There is
+// no 2FA: these connectors don't have any.
+func performDexPasswordSteps(w *pageWatch, config *Config, steps *stepTimer, timeout time.Duration) error {
+	callback, err := config.loginCallback()
+	if err != nil {
+		return err
+	}
+	// Prompts deferred because of a stored session happen now.
+	if err := config.promptForCredentials(w.ctx); err != nil {
+		return err
+	}
+
+	log.Info("Filling Dex credentials...")
+	login, err := findElement(w, XPathDexLogin, "Dex login field", timeout)
+	if err != nil {
+		return err
+	}
+	if err := login.Input(config.Username); err != nil {
+		return fmt.Errorf("failed to input Dex login field: %v", err)
+	}
+	steps.done("username")
+
+	if err := fillAndSubmitField(w, XPathDexPassword, config.Password, "Dex password field", timeout); err != nil {
+		return err
+	}
+	steps.done("password")
+
+	log.Info("Waiting for login callback...", "callback", callback)
+	first, err := dexWait(w, config, timeout, "redirect to "+callback.String(), w.atCallback(callback), hasX(XPathDexLoginError))
+	if err != nil {
+		return err
+	}
+	if first == 1 {
+		return credentialsRejected(config, "Dex rejected the credentials: %s", errorText(w, XPathDexLoginError, "invalid username or password"))
+	}
+	steps.done("callback")
+	return nil
+}
+
+// dexConnector is one entry of Dex's connector chooser.
+type dexConnector struct {
+	ID   string
+	Name string
+	Href string
+
+	link *rod.Element // the entry's link on the page
+}
+
+func (c dexConnector) String() string {
+	return fmt.Sprintf("%s (%s)", c.ID, c.Name)
+}
+
+// chooseDexConnector clicks the --dex-connector entry of Dex's chooser.
+func chooseDexConnector(w *pageWatch, config *Config, timeout time.Duration) error {
+	links, err := w.page.ElementsX(XPathDexConnector)
+	if err != nil {
+		return fmt.Errorf("failed to list Dex connectors: %v", err)
+	}
+	connectors := make([]dexConnector, 0, len(links))
+	for _, link := range links {
+		href, err := link.Attribute("href")
+		if err != nil || href == nil {
+			continue
+		}
+		text, err := link.Text()
+		if err != nil {
+			continue
+		}
+		c := parseDexConnector(*href, text)
+		c.link = link
+		connectors = append(connectors, c)
+	}
+
+	c, err := matchDexConnector(connectors, config.DexConnector)
+	if err != nil {
+		return err
+	}
+	log.Info("Choosing Dex connector", "connector", c)
+	if err := c.link.Click(proto.InputMouseButtonLeft, 1); err != nil {
+		return fmt.Errorf("failed to click Dex connector %s: %v", c.ID, err)
+	}
+	_, err = w.wait(timeout, "Dex to leave the connector chooser", lacksX(XPathDexConnector))
+	return err
+}
+
+// parseDexConnector reads a chooser entry: the ID from the link, the name
+// from its "Log in with <name>" label.
+func parseDexConnector(href, text string) dexConnector {
+	c := dexConnector{Href: href, Name: strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), "Log in with"))}
+	if u, err := url.Parse(href); err == nil {
+		if id, err := url.PathUnescape(path.Base(u.Path)); err == nil {
+			c.ID = id
+		}
+	}
+	return c
+}
+
+// matchDexConnector picks the connector named by want, matched on its ID or,
+// ignoring case, its name.
+func matchDexConnector(connectors []dexConnector, want string) (dexConnector, error) {
+	if want == "" {
+		return dexConnector{}, fmt.Errorf("Dex offers several connectors; choose one with --dex-connector: %s", listDexConnectors(connectors))
+	}
+	for _, c := range connectors {
+		if c.ID == want {
+			return c, nil
+		}
+	}
+	for _, c := range connectors {
+		if strings.EqualFold(c.Name, want) {
+			return c, nil
+		}
+	}
+	return dexConnector{}, fmt.Errorf("Dex has no connector %q; it offers %s", want, listDexConnectors(connectors))
+}
+
+func listDexConnectors(connectors []dexConnector) string {
+	names := make([]string, len(connectors))
+	for i, c := range connectors {
+		names[i] = c.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// approveDexClient grants access on Dex's approval screen, if the login's
+// client_id is allowlisted with --dex-approve-client. Any other client is
+// refused, so a crafted auth URL can't be granted access unattended.
+func approveDexClient(w *pageWatch, config *Config, timeout time.Duration) error {
+	client := dexClientID(config.DexURL)
+	if client == "" || !slices.Contains(config.DexApproveClients, client) {
+		return fmt.Errorf("Dex asks to grant client %q access, which isn't allowlisted; approve it with --dex-approve-client %s", client, client)
+	}
+
+	log.Info("Granting access on the Dex approval screen", "client", client)
+	if err := clickButton(w, XPathDexApprove, "Dex Grant Access button", timeout); err != nil {
+		return err
+	}
+	// Wait for the form to post, so the screen isn't approved twice.
+	_, err := w.wait(timeout, "the Dex approval to be submitted", lacksX(XPathDexApprove))
+	return err
+}
+
+// dexClientID returns the client_id of a Dex auth URL.
+func dexClientID(dexURL string) string {
+	u, err := url.Parse(dexURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("client_id")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDexConnectorAndApproval checks how --dex-connector picks an entry of
+// Dex's chooser, and that the approval screen is only granted to allowlisted
+// clients.
+func TestDexConnectorAndApproval(t *testing.T) {
+	connectors := []dexConnector{
+		parseDexConnector("/dex/auth/github?req=abc", "\n  Log in with GitHub\n"),
+		parseDexConnector("/dex/auth/aws-idc?req=abc", "Log in with AWS IAM Identity Center"),
+		parseDexConnector("/dex/auth/ldap%20corp?req=abc", "Log in with LDAP"),
+	}
+	if c := connectors[1]; c.ID != "aws-idc" || c.Name != "AWS IAM Identity Center" {
+		t.Errorf("parsed connector = %+v", c)
+	}
+
+	for want, id := range map[string]string{
+		"aws-idc":                 "aws-idc",
+		"aws iam identity center": "aws-idc",
+		"ldap corp":               "ldap corp",
+		"GitHub":                  "github",
+	} {
+		if c, err := matchDexConnector(connectors, want); err != nil || c.ID != id {
+			t.Errorf("matchDexConnector(%q) = %v, %v; want %s", want, c, err, id)
+		}
+	}
+	for _, want := range []string{"", "okta"} {
+		_, err := matchDexConnector(connectors, want)
+		if err == nil || !strings.Contains(err.Error(), "github (GitHub), aws-idc (AWS IAM Identity Center), ldap corp (LDAP)") {
+			t.Errorf("matchDexConnector(%q) = %v; want the connectors listed", want, err)
+		}
+	}
+
+	// Refusal happens before the page is touched.
+	w := newPageWatch(t.Context())
+	for _, config := range []*Config{
+		{DexURL: "https://dex.example.com/auth?client_id=argo-cd-cli&redirect_uri=http://localhost:8085/auth/callback"},
+		{DexURL: "https://dex.example.com/auth?client_id=evil&redirect_uri=http://localhost:8085/auth/callback", DexApproveClients: []string{"argo-cd-cli"}},
+		{DexURL: "https://dex.example.com/auth?redirect_uri=http://localhost:8085/auth/callback", DexApproveClients: []string{""}},
+	} {
+		err := approveDexClient(w, config, time.Second)
+		if err == nil || !strings.Contains(err.Error(), "isn't allowlisted") {
+			t.Errorf("approving %s with allowlist %q = %v", config.DexURL, config.DexApproveClients, err)
+		}
+	}
+}
+
+// TestDexPasswordLogin logs in through a running Dex's static password
+// connector, approves its approval screen and checks that the callback
+// reaches the listener. Dex is started from testdata/dex.yaml and its issuer
+// URL passed in AWSSSOLOGIN_TEST_DEX.
+func TestDexPasswordLogin(t *testing.T) {
+	issuer := os.Getenv("AWSSSOLOGIN_TEST_DEX")
+	if testing.Short() || issuer == "" {
+		t.Skip("skipping Dex login test: needs a browser and AWSSSOLOGIN_TEST_DEX")
+	}
+
+	codes := make(chan string, 1)
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case codes <- r.URL.Query().Get("code"):
+		default:
+		}
+		w.Write([]byte("Authentication successful."))
+	}))
+	defer listener.Close()
+
+	authURL := issuer + "/auth?" + url.Values{
+		"client_id":     {"awsssologin-test"},
+		"redirect_uri":  {listener.URL + "/auth/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+		"state":         {"test"},
+	}.Encode()
+	config := &Config{
+		DexURL:            authURL,
+		Username:          "admin@example.com",
+		Password:          NewSecret("password"),
+		TOTPSecret:        NewSecret("JBSWY3DPEHPK3PXP"),
+		TimeoutSeconds:    30,
+		DexConnector:      "local",
+		DexApproveClients: []string{"awsssologin-test"},
+	}
+	if err := automateBrowserLogin(t.Context(), authURL, config, nil); err != nil {
+		t.Fatalf("Dex login: %v", err)
+	}
+	select {
+	case code := <-codes:
+		if code == "" {
+			t.Error("the callback carries no code")
+		}
+	default:
+		t.Error("the callback never reached the listener")
+	}
+
+	config.Password = NewSecret("wrong")
+	err := automateBrowserLogin(t.Context(), authURL, config, nil)
+	if err == nil || !strings.Contains(err.Error(), "Dex rejected the credentials") {
+		t.Errorf("Dex login with a wrong password = %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/proto"
+	"github.com/pquerna/otp/totp"
+	"github.com/spf13/cobra"
+)
+
+// Outcomes of a `doctor` check.
+const (
+	StatusPass = "pass"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+const (
+	// DoctorProbeTimeout bounds launching and connecting to the browser.
+	DoctorProbeTimeout = 30 * time.Second
+	// DoctorHTTPTimeout bounds each network request made by `doctor`.
+	DoctorHTTPTimeout = 10 * time.Second
+	// DefaultClockCheckURL is asked for the time when no login URL is given.
+	DefaultClockCheckURL = "https://oidc.us-east-1.amazonaws.com"
+	// ClockSkewWarn and ClockSkewFail are the clock-skew thresholds. TOTP
+	// codes are accepted about one 30s period either side of the server time.
+	ClockSkewWarn = 10 * time.Second
+	ClockSkewFail = 30 * time.Second
+)
+
+// MinAWSCLIVersion is the first AWS CLI release whose `aws sso login`
+// supports --use-device-code.
+var MinAWSCLIVersion = [3]int{2, 22, 0}
+
+// knownEnvVars are the environment variables awsssologin reads.
+var knownEnvVars = map[string]bool{
+	"AWSSSOLOGIN_USERNAME":    true,
+	"AWSSSOLOGIN_PASSWORD":    true,
+	"AWSSSOLOGIN_2FA":         true,
+	"AWSSSOLOGIN_TOTP_SECRET": true,
+	"AWSSSOLOGIN_2FA_CMD":     true,
+	"AWSSSOLOGIN_CONFIG":      true,
+	"AWSSSOLOGIN_IDENTITY":    true,
+	EnvBrowserBin:             true,
+	EnvOffline:                true,
+	EnvProxyPassword:          true,
+}
+
+// doctorCheck is one line of the `doctor` report.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// newDoctorCmd builds the `doctor` command. It takes the same flags as a
+// login, so the checks see the same merged configuration.
+func newDoctorCmd(config *Config) *cobra.Command {
+	var jsonOutput bool
+
+	doctorCmd := &cobra.Command{
+		Use:          "doctor",
+		Short:        "Check the environment a login depends on",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			checks := config.runDoctorChecks(cmd)
+			if jsonOutput {
+				if err := writeDoctorJSON(os.Stdout, checks); err != nil {
+					return err
+				}
+			} else {
+				printDoctorChecks(os.Stdout, checks)
+			}
+
+			failed := 0
+			for _, c := range checks {
+				if c.Status == StatusFail {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d check(s) failed", failed)
+			}
+			return nil
+		},
+	}
+	doctorCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	return doctorCmd
+}
+
+// runDoctorChecks runs every check in order. A configuration that doesn't
+// validate is reported as a failed check; the remaining checks then run
+// against whatever could be merged.
+func (c *Config) runDoctorChecks(cmd *cobra.Command) []doctorCheck {
+	var checks []doctorCheck
+
+	if err := c.prepareSubcommand(cmd); err != nil {
+		checks = append(checks, doctorCheck{"config", StatusFail, err.Error()})
+	} else {
+		checks = append(checks, c.checkConfig())
+	}
+
+	if c.usesRemoteBrowser() {
+		checks = append(checks, checkRemoteBrowser(c))
+	} else {
+		checks = append(checks, checkProxy(c))
+		browser := checkBrowserBinary(c)
+		checks = append(checks, browser)
+		if browser.Status == StatusPass {
+			checks = append(checks, checkBrowserLaunch(cmd.Context(), c))
+		}
+	}
+
+	return append(checks,
+		checkAWSCLI(cmd.Context()),
+		checkClock(c),
+		checkEnv(),
+		checkTOTPSecret(cmd.Context(), c),
+		checkDebugDir(c),
+	)
+}
+
+// checkConfig reports which settings files and identity were picked up.
+func (c *Config) checkConfig() doctorCheck {
+	var parts []string
+	if c.file != nil {
+		parts = append(parts, "config file "+c.filePath)
+	} else {
+		parts = append(parts, "no config file")
+	}
+	if c.identityName != "" {
+		parts = append(parts, "identity "+c.identityName)
+	}
+	if c.awsSession != nil {
+		parts = append(parts, "aws-config sso-session "+c.awsSession.Name)
+	}
+	return doctorCheck{"config", StatusPass, strings.Join(parts, ", ")}
+}
+
+// checkProxy reports the browser's proxy and the --ca-file certificates.
+// Proxy authentication is only checked at login, when the proxy asks for it.
+func checkProxy(config *Config) doctorCheck {
+	proxy, err := config.resolveProxy()
+	if err != nil {
+		return doctorCheck{"proxy", StatusFail, err.Error()}
+	}
+	defer proxy.wipe()
+
+	detail := proxy.describe()
+	if config.CAFile != "" {
+		certs, err := readCAFile(config.CAFile)
+		if err != nil {
+			return doctorCheck{"proxy", StatusFail, err.Error()}
+		}
+		var names []string
+		for _, cert := range certs {
+			names = append(names, cert.Subject.CommonName)
+		}
+		detail += fmt.Sprintf("; trusting %s from %s", strings.Join(names, ", "), config.CAFile)
+	}
+	return doctorCheck{"proxy", StatusPass, detail}
+}
+
+// checkBrowserBinary finds the browser a login would use, with
+// resolveBrowserBin. If there is none it checks that a download host is
+// reachable; the download itself is left to the first login.
+func checkBrowserBinary(config *Config) doctorCheck {
+	bin, err := resolveBrowserBin(config)
+	if err != nil {
+		return doctorCheck{"browser", StatusFail, err.Error()}
+	}
+	if bin.Source != BrowserSourceDownload {
+		return doctorCheck{"browser", StatusPass, fmt.Sprintf("%s (%s)", bin.Path, bin.Source)}
+	}
+
+	b := launcher.NewBrowser()
+	client, err := config.httpClient(DoctorHTTPTimeout)
+	if err != nil {
+		return doctorCheck{"browser", StatusFail, err.Error()}
+	}
+	for _, host := range b.Hosts {
+		u := host(b.Revision)
+		resp, err := client.Head(u)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < http.StatusBadRequest {
+			return doctorCheck{"browser", StatusWarn, fmt.Sprintf(
+				"no browser installed; the first login downloads Chromium r%d from %s", b.Revision, urlHost(u))}
+		}
+	}
+	return doctorCheck{"browser", StatusFail, fmt.Sprintf(
+		"no browser installed and no host to download Chromium r%d from is reachable; pass --browser-bin", b.Revision)}
+}
+
+// checkBrowserLaunch starts the browser with the login's launcher setup,
+// always headless, connects to it and reads its version.
+func checkBrowserLaunch(ctx context.Context, config *Config) doctorCheck {
+	ctx, cancel := context.WithTimeout(ctx, DoctorProbeTimeout)
+	defer cancel()
+
+	bin, err := resolveBrowserBin(config)
+	if err != nil {
+		return doctorCheck{"browser-launch", StatusFail, err.Error()}
+	}
+	proxy, err := config.resolveProxy()
+	if err != nil {
+		return doctorCheck{"browser-launch", StatusFail, err.Error()}
+	}
+	defer proxy.wipe()
+	l, err := newLauncher(config, bin, proxy)
+	if err != nil {
+		return doctorCheck{"browser-launch", StatusFail, err.Error()}
+	}
+	l = l.Headless(true).Context(ctx)
+	defer l.Cleanup()
+	defer l.Kill()
+
+	u, err := l.Launch()
+	if err != nil {
+		return doctorCheck{"browser-launch", StatusFail, fmt.Sprintf("failed to launch browser: %v", err)}
+	}
+	browser := rod.New().ControlURL(u).Context(ctx)
+	if err := browser.Connect(); err != nil {
+		return doctorCheck{"browser-launch", StatusFail, fmt.Sprintf("failed to connect to browser at %s: %v", u, err)}
+	}
+	defer browser.Close()
+
+	version, err := proto.BrowserGetVersion{}.Call(browser)
+	if err != nil {
+		return doctorCheck{"browser-launch", StatusFail, fmt.Sprintf("failed to read browser version: %v", err)}
+	}
+	return doctorCheck{"browser-launch", StatusPass, version.Product}
+}
+
+// checkRemoteBrowser attaches to the --browser-ws/--browser-url endpoint the
+// way a login does, in an isolated context, and reads the browser's version.
+func checkRemoteBrowser(config *Config) doctorCheck {
+	session, err := attachRemoteBrowser(config)
+	if err != nil {
+		return doctorCheck{"browser-remote", StatusFail, err.Error()}
+	}
+	defer session.close()
+
+	version, err := proto.BrowserGetVersion{}.Call(session.browser)
+	if err != nil {
+		return doctorCheck{"browser-remote", StatusFail, fmt.Sprintf("failed to read browser version: %v", err)}
+	}
+	return doctorCheck{"browser-remote", StatusPass, version.Product}
+}
+
+// checkAWSCLI checks that the AWS CLI is installed and new enough for
+// `aws sso login --use-device-code`.
+func checkAWSCLI(ctx context.Context) doctorCheck {
+	path, err := exec.LookPath("aws")
+	if err != nil {
+		return doctorCheck{"aws-cli", StatusWarn, "aws not found in PATH; it prints the URL awsssologin reads"}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DoctorHTTPTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		return doctorCheck{"aws-cli", StatusFail, fmt.Sprintf("%s --version failed: %v", path, err)}
+	}
+
+	version, err := parseAWSCLIVersion(string(out))
+	if err != nil {
+		return doctorCheck{"aws-cli", StatusWarn, err.Error()}
+	}
+	detail := fmt.Sprintf("aws-cli %d.%d.%d at %s", version[0], version[1], version[2], path)
+	if versionLess(version, MinAWSCLIVersion) {
+		return doctorCheck{"aws-cli", StatusFail, fmt.Sprintf("%s does not support --use-device-code (needs %d.%d.%d or later)",
+			detail, MinAWSCLIVersion[0], MinAWSCLIVersion[1], MinAWSCLIVersion[2])}
+	}
+	return doctorCheck{"aws-cli", StatusPass, detail}
+}
+
+var awsCLIVersionRe = regexp.MustCompile(`aws-cli/(\d+)\.(\d+)\.(\d+)`)
+
+// parseAWSCLIVersion extracts the version from `aws --version` output, e.g.
+// "aws-cli/2.22.5 Python/3.12.6 Linux/6.8.0 exe/x86_64".
+func parseAWSCLIVersion(out string) ([3]int, error) {
+	var version [3]int
+	m := awsCLIVersionRe.FindStringSubmatch(out)
+	if m == nil {
+		return version, fmt.Errorf("unrecognized aws --version output: %q", strings.TrimSpace(out))
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(m[i+1])
+	}
+	return version, nil
+}
+
+// versionLess reports whether version a is older than b.
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// checkClock compares the local clock with the Date header of the login host
+// (or DefaultClockCheckURL). A skewed clock yields rejected TOTP codes.
+func checkClock(config *Config) doctorCheck {
+	target := DefaultClockCheckURL
+	if host := urlHost(config.literalURL()); host != "" {
+		target = "https://" + host
+	}
+
+	client, err := config.httpClient(DoctorHTTPTimeout)
+	if err != nil {
+		return doctorCheck{"clock", StatusWarn, err.Error()}
+	}
+	start := time.Now()
+	resp, err := client.Head(target)
+	if err != nil {
+		return doctorCheck{"clock", StatusWarn, fmt.Sprintf("could not reach %s to compare clocks: %v", target, err)}
+	}
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return doctorCheck{"clock", StatusWarn, fmt.Sprintf("%s sent no usable Date header", target)}
+	}
+	return clockSkewCheck(serverTime.Sub(start.Add(elapsed/2)), urlHost(target))
+}
+
+// clockSkewCheck grades a measured skew. The Date header has one-second
+// resolution, so that much is forgiven.
+func clockSkewCheck(skew time.Duration, host string) doctorCheck {
+	abs := skew.Abs() - time.Second
+	detail := fmt.Sprintf("%s off from %s", skew.Round(time.Second), host)
+	switch {
+	case abs > ClockSkewFail:
+		return doctorCheck{"clock", StatusFail, detail}
+	case abs > ClockSkewWarn:
+		return doctorCheck{"clock", StatusWarn, detail}
+	}
+	return doctorCheck{"clock", StatusPass, detail}
+}
+
+// checkEnv lists which AWSSSOLOGIN_* variables are set, by name only, and
+// flags unknown ones as likely typos.
+func checkEnv() doctorCheck {
+	var set, unknown []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "AWSSSOLOGIN_") {
+			continue
+		}
+		// AWSSSOLOGIN_MFA_* is what we pass to --2fa-cmd, not read from.
+		if knownEnvVars[name] || strings.HasPrefix(name, "AWSSSOLOGIN_MFA_") {
+			set = append(set, name)
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(set)
+	sort.Strings(unknown)
+
+	detail := "none set"
+	if len(set) > 0 {
+		detail = "set: " + strings.Join(set, ", ")
+	}
+	if len(unknown) > 0 {
+		return doctorCheck{"env", StatusWarn, detail + "; unknown: " + strings.Join(unknown, ", ")}
+	}
+	return doctorCheck{"env", StatusPass, detail}
+}
+
+// checkTOTPSecret checks that the TOTP secret, wherever it would come from,
+// is valid base32 for the configured TOTP parameters. A secret on a file
+// descriptor is not read, since it can only be read once.
+func checkTOTPSecret(ctx context.Context, config *Config) doctorCheck {
+	var (
+		secret Secret
+		source string
+	)
+	switch {
+	case config.TOTPSecret.IsSet():
+		secret, source = config.TOTPSecret, "--totp-secret"
+	case config.TOTPSecretFD >= 0:
+		return doctorCheck{"totp-secret", StatusWarn, fmt.Sprintf("not checked: read from fd %d at login", config.TOTPSecretFD)}
+	case os.Getenv("AWSSSOLOGIN_TOTP_SECRET") != "":
+		secret, source = NewSecret(os.Getenv("AWSSSOLOGIN_TOTP_SECRET")), "AWSSSOLOGIN_TOTP_SECRET"
+		defer secret.Wipe()
+	case config.fileIdentity.TOTPSecret != nil:
+		ref := config.fileIdentity.TOTPSecret
+		source = ref.describe()
+		var err error
+		if secret, err = ref.resolve(ctx); err != nil {
+			return doctorCheck{"totp-secret", StatusFail, fmt.Sprintf("%s: %v", source, err)}
+		}
+		defer secret.Wipe()
+	default:
+		return doctorCheck{"totp-secret", StatusPass, "not configured"}
+	}
+
+	opts, err := totpOpts(config.TOTP)
+	if err != nil {
+		return doctorCheck{"totp-secret", StatusFail, err.Error()}
+	}
+	if _, err := totp.GenerateCodeCustom(secret.Reveal(), time.Now(), opts); err != nil {
+		return doctorCheck{"totp-secret", StatusFail, fmt.Sprintf("%s: not a valid TOTP secret: %v", source, err)}
+	}
+	return doctorCheck{"totp-secret", StatusPass, fmt.Sprintf("valid base32 from %s (%d digits, %s, %ds)",
+		source, opts.Digits.Length(), opts.Algorithm, opts.Period)}
+}
+
+// checkDebugDir checks that failure dumps can be written.
+func checkDebugDir(config *Config) doctorCheck {
+	dir := debugDir(config)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return doctorCheck{"debug-dir", StatusFail, fmt.Sprintf("cannot create %s: %v", dir, err)}
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return doctorCheck{"debug-dir", StatusFail, fmt.Sprintf("%s is not writable: %v", dir, err)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return doctorCheck{"debug-dir", StatusPass, dir + " is writable"}
+}
+
+// printDoctorChecks writes the report as an aligned table.
+func printDoctorChecks(out io.Writer, checks []doctorCheck) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Status, c.Detail)
+	}
+	w.Flush()
+}
+
+// writeDoctorJSON writes the report as a JSON array of checks.
+func writeDoctorJSON(out io.Writer, checks []doctorCheck) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(checks)
+}
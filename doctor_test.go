@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDoctorOfflineChecks covers the checks that need neither a browser nor
+// the network: version and skew grading, env listing, TOTP secret and debug
+// dir.
+func TestDoctorOfflineChecks(t *testing.T) {
+	version, err := parseAWSCLIVersion("aws-cli/2.22.5 Python/3.12.6 Linux/6.8.0 exe/x86_64.ubuntu.24\n")
+	if err != nil || version != [3]int{2, 22, 5} {
+		t.Errorf("parseAWSCLIVersion = %v, %v", version, err)
+	}
+	if !versionLess([3]int{2, 9, 30}, MinAWSCLIVersion) || versionLess(version, MinAWSCLIVersion) {
+		t.Error("versionLess compares component by component")
+	}
+	if _, err := parseAWSCLIVersion("command not found"); err == nil {
+		t.Error("expected an error for unrecognized output")
+	}
+
+	for skew, want := range map[time.Duration]string{
+		-time.Second:     StatusPass,
+		20 * time.Second: StatusWarn,
+		-2 * time.Minute: StatusFail,
+	} {
+		if got := clockSkewCheck(skew, "example.com").Status; got != want {
+			t.Errorf("clockSkewCheck(%s) = %s, want %s", skew, got, want)
+		}
+	}
+
+	t.Setenv("AWSSSOLOGIN_USERNAME", "alice")
+	t.Setenv("AWSSSOLOGIN_PASWORD", "typo")
+	env := checkEnv()
+	if env.Status != StatusWarn || !strings.Contains(env.Detail, "AWSSSOLOGIN_USERNAME") ||
+		!strings.Contains(env.Detail, "unknown: AWSSSOLOGIN_PASWORD") || strings.Contains(env.Detail, "alice") {
+		t.Errorf("checkEnv = %+v", env)
+	}
+
+	config := &Config{TOTPSecretFD: -1}
+	if got := checkTOTPSecret(t.Context(), config); got.Status != StatusPass || got.Detail != "not configured" {
+		t.Errorf("checkTOTPSecret without a secret = %+v", got)
+	}
+	t.Setenv("AWSSSOLOGIN_TOTP_SECRET", "JBSWY3DPEHPK3PXP")
+	if got := checkTOTPSecret(t.Context(), config); got.Status != StatusPass {
+		t.Errorf("checkTOTPSecret with a valid secret = %+v", got)
+	}
+	config.TOTPSecret = NewSecret("not base32!")
+	if got := checkTOTPSecret(t.Context(), config); got.Status != StatusFail || !strings.Contains(got.Detail, "--totp-secret") {
+		t.Errorf("checkTOTPSecret with an invalid secret = %+v", got)
+	}
+	config.TOTPSecret.Wipe()
+
+	config.DebugDir = filepath.Join(t.TempDir(), "dumps")
+	if got := checkDebugDir(config); got.Status != StatusPass {
+		t.Errorf("checkDebugDir = %+v", got)
+	}
+}
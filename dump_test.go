@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -83,3 +86,45 @@ func TestDumpFailureInfo(t *testing.T) {
 		t.Errorf("expected diagnostics to name the covering overlay element, got: %s", got)
 	}
 }
+
+// TestDumpMetadataRedactsSecrets checks that the dump metadata, and any fmt
+// verb applied to the config or its secrets, never reveals a secret value.
+func TestDumpMetadataRedactsSecrets(t *testing.T) {
+	const password, totpSecret, twoFA = "hunter2-password", "JBSWY3DPEHPK3PXP", "654321"
+	config := &Config{
+		Username:       "smoke@example.com",
+		Password:       NewSecret(password),
+		TOTPSecret:     NewSecret(totpSecret),
+		TwoFA:          NewSecret(twoFA),
+		TimeoutSeconds: 30,
+	}
+	defer config.wipeSecrets()
+
+	var out strings.Builder
+	writeDumpMetadata(&out, config, errors.New("simulated failure"), "https://example.com", "Smoke")
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		fmt.Fprintf(&out, verb+"\n", config)
+		fmt.Fprintf(&out, verb+"\n", *config)
+		fmt.Fprintf(&out, verb+"\n", config.Password)
+	}
+	if b, err := json.Marshal(config); err != nil {
+		t.Fatalf("marshal config: %v", err)
+	} else {
+		out.Write(b)
+	}
+
+	got := out.String()
+	for _, secret := range []string{password, totpSecret, twoFA, hex.EncodeToString([]byte(password))} {
+		if strings.Contains(strings.ToLower(got), strings.ToLower(secret)) {
+			t.Errorf("secret %q leaked into formatted output:\n%s", secret, got)
+		}
+	}
+	if !strings.Contains(got, redacted) {
+		t.Errorf("expected secrets to print as %s, got:\n%s", redacted, got)
+	}
+
+	config.wipeSecrets()
+	if config.Password.IsSet() || config.Password.Reveal() != "" {
+		t.Error("password still readable after wipeSecrets")
+	}
+}
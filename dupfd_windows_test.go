@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// dupFD returns a new handle for f, owned by whoever it is handed to.
+func dupFD(t *testing.T, f *os.File) int {
+	t.Helper()
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handle syscall.Handle
+	if err := syscall.DuplicateHandle(process, syscall.Handle(f.Fd()), process, &handle, 0, false, syscall.DUPLICATE_SAME_ACCESS); err != nil {
+		t.Fatal(err)
+	}
+	return int(handle)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// blockedResourceTypes are never needed to drive a login: they are blocked
+// unless they come from an allowed host.
+var blockedResourceTypes = map[proto.NetworkResourceType]bool{
+	proto.NetworkResourceTypeImage: true,
+	proto.NetworkResourceTypeMedia: true,
+	proto.NetworkResourceTypeFont:  true,
+}
+
+// telemetryResourceTypes are beacons and reports, blocked whatever their host.
+var telemetryResourceTypes = map[proto.NetworkResourceType]bool{
+	proto.NetworkResourceTypePing:               true,
+	proto.NetworkResourceTypeCSPViolationReport: true,
+}
+
+// blockedHosts are analytics and advertising hosts whose requests are all
+// blocked. A leading "*." also matches the domain itself.
+var blockedHosts = []string{
+	"*.google-analytics.com",
+	"*.googletagmanager.com",
+	"*.doubleclick.net",
+	"*.amazon-adsystem.com",
+	"fls-na.amazon.com",
+	"unagi.amazon.com",
+	"unagi-na.amazon.com",
+}
+
+// allowedHosts are the sign-in and access portal hosts, whose images and
+// fonts are kept (e.g. a CAPTCHA). The login URL's own host and its
+// redirect_uri's are added per login.
+var allowedHosts = []string{
+	"*.signin.aws",
+	"signin.aws.amazon.com",
+	"*.awsapps.com",
+}
+
+// requestInterceptor handles the Fetch domain of one login page: it blocks
+// requests a headless login doesn't need, relays the OAuth callback (see
+// relay.go), and answers proxy authentication challenges with the proxy
+// credentials. A page has one Fetch configuration, so all of it is done here
+// rather than with rod's HijackRequests.
+type requestInterceptor struct {
+	block         bool
+	allow         []string
+	relay         *callbackRelay
+	relayFailed   func(error) // fails the login's waits
+	proxyUser     string
+	proxyPassword Secret
+
+	blocked  atomic.Int64
+	answered map[proto.FetchRequestID]bool // proxy challenges answered, by request
+}
+
+// interceptRequests starts intercepting the page's requests, before it
+// navigates to loginURL. Blocking is on unless --block-requests=false; the
+// Dex callback is relayed with --relay-callback, and a relay failure is
+// reported to watch; proxy authentication is on when the session has proxy
+// credentials. The returned function stops intercepting and reports the
+// number of blocked requests.
+func (s *browserSession) interceptRequests(page *rod.Page, loginURL string, config *Config, watch *pageWatch) (func() int64, error) {
+	ri := &requestInterceptor{
+		block:         config.BlockRequests,
+		relayFailed:   watch.fail,
+		proxyUser:     s.proxyUser,
+		proxyPassword: s.proxyPassword,
+		answered:      map[proto.FetchRequestID]bool{},
+	}
+	// An out-of-band login has no local listener to relay to.
+	if config.DexURL != "" && config.relaysCallback() && !config.outOfBand() {
+		callback, err := oidcCallbackFor(config.DexURL)
+		if err != nil {
+			return nil, err
+		}
+		ri.relay = newCallbackRelay(callback.origin, time.Duration(config.TimeoutSeconds)*time.Second)
+		log.Debug("Relaying the login callback from this process", "listener", callback.origin)
+	}
+	if !ri.block && ri.relay == nil && ri.proxyUser == "" {
+		return func() int64 { return 0 }, nil
+	}
+	ri.allow = append(loginHosts(loginURL), allowedHosts...)
+
+	ctx, cancel := context.WithCancel(page.GetContext())
+	p := page.Context(ctx)
+	if err := (proto.FetchEnable{HandleAuthRequests: ri.proxyUser != ""}).Call(p); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to enable request interception: %v", err)
+	}
+	wait := p.EachEvent(func(e *proto.FetchRequestPaused) {
+		go ri.paused(p, e)
+	}, func(e *proto.FetchAuthRequired) {
+		ri.authRequired(p, e)
+	})
+	go wait()
+
+	return func() int64 {
+		// Requests paused from here on would never be continued.
+		_ = proto.FetchDisable{}.Call(page)
+		cancel()
+		return ri.blocked.Load()
+	}, nil
+}
+
+// paused relays, blocks or continues a paused request.
+func (ri *requestInterceptor) paused(p *rod.Page, e *proto.FetchRequestPaused) {
+	if ri.relay != nil && ri.relay.matches(e.Request.URL) {
+		fulfill, err := ri.relay.forward(e)
+		if err != nil {
+			ri.relayFailed(err)
+			_ = proto.FetchFailRequest{RequestID: e.RequestID, ErrorReason: proto.NetworkErrorReasonConnectionRefused}.Call(p)
+			return
+		}
+		_ = fulfill.Call(p)
+		return
+	}
+	if ri.block && ri.blocks(e.ResourceType, e.Request.URL) {
+		ri.blocked.Add(1)
+		log.Debug("Blocked request", "type", e.ResourceType, "url", e.Request.URL)
+		_ = proto.FetchFailRequest{RequestID: e.RequestID, ErrorReason: proto.NetworkErrorReasonBlockedByClient}.Call(p)
+		return
+	}
+	_ = proto.FetchContinueRequest{RequestID: e.RequestID}.Call(p)
+}
+
+// blocks reports whether a request is blocked.
+func (ri *requestInterceptor) blocks(resourceType proto.NetworkResourceType, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false // data: URLs and the like cost nothing
+	}
+	host := u.Hostname()
+	switch {
+	case telemetryResourceTypes[resourceType], matchHost(blockedHosts, host):
+		return true
+	case blockedResourceTypes[resourceType]:
+		return !matchHost(ri.allow, host)
+	}
+	return false
+}
+
+// authRequired answers a proxy challenge with the proxy credentials; server
+// challenges are left to the browser. Credentials the proxy rejects are not
+// retried, so a wrong password fails the login instead of looping.
+func (ri *requestInterceptor) authRequired(p *rod.Page, e *proto.FetchAuthRequired) {
+	resp := &proto.FetchAuthChallengeResponse{Response: proto.FetchAuthChallengeResponseResponseDefault}
+	switch {
+	case e.AuthChallenge.Source != proto.FetchAuthChallengeSourceProxy:
+	case ri.answered[e.RequestID]:
+		log.Error("Proxy rejected the credentials", "proxy", e.AuthChallenge.Origin, "username", ri.proxyUser)
+		resp.Response = proto.FetchAuthChallengeResponseResponseCancelAuth
+	default:
+		ri.answered[e.RequestID] = true
+		log.Debug("Answering proxy authentication challenge", "proxy", e.AuthChallenge.Origin)
+		resp.Response = proto.FetchAuthChallengeResponseResponseProvideCredentials
+		resp.Username, resp.Password = ri.proxyUser, ri.proxyPassword.Reveal()
+	}
+	go func() { _ = proto.FetchContinueWithAuth{RequestID: e.RequestID, AuthChallengeResponse: resp}.Call(p) }()
+}
+
+// loginHosts returns the hosts of a login URL and of its redirect_uri.
+func loginHosts(loginURL string) []string {
+	var hosts []string
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return nil
+	}
+	hosts = append(hosts, u.Hostname())
+	if r, err := url.Parse(u.Query().Get("redirect_uri")); err == nil && r.Hostname() != "" {
+		hosts = append(hosts, r.Hostname())
+	}
+	return hosts
+}
+
+// matchHost reports whether host matches one of patterns: a host name, or
+// "*.domain" for the domain and its subdomains.
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// stepTimer times the steps of a login: each at debug level as it finishes,
+// all of them in one line at the end.
+type stepTimer struct {
+	start, last time.Time
+	steps       []any // key/value pairs for the summary
+}
+
+func newStepTimer() *stepTimer {
+	now := time.Now()
+	return &stepTimer{start: now, last: now}
+}
+
+// done records that step has finished.
+func (t *stepTimer) done(step string) {
+	now := time.Now()
+	took := now.Sub(t.last).Round(time.Millisecond)
+	log.Debug("Login step done", "step", step, "took", took)
+	t.steps = append(t.steps, step, took)
+	t.last = now
+}
+
+// summary logs every step's time, the total, and extra key/value pairs.
+func (t *stepTimer) summary(extra ...any) {
+	kv := append(t.steps, "total", time.Since(t.start).Round(time.Millisecond))
+	log.Info("Login step timings", append(kv, extra...)...)
+}
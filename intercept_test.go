@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// TestRequestBlocking checks which requests a login page may make: images and
+// fonts only from the sign-in, portal and login hosts, no analytics or
+// beacons, and everything else untouched.
+func TestRequestBlocking(t *testing.T) {
+	ri := &requestInterceptor{block: true, allow: append(loginHosts(testDexURL), allowedHosts...)}
+
+	for _, tt := range []struct {
+		typ  proto.NetworkResourceType
+		url  string
+		want bool
+	}{
+		{proto.NetworkResourceTypeImage, "https://a.b.cdn.console.awsstatic.com/logo.png", true},
+		{proto.NetworkResourceTypeFont, "https://fonts.example.net/amazon-ember.woff2", true},
+		{proto.NetworkResourceTypeImage, "https://us-east-1.signin.aws/captcha.jpg", false},
+		{proto.NetworkResourceTypeImage, "https://corp.awsapps.com/start/logo.svg", false},
+		{proto.NetworkResourceTypeImage, "https://argocd.example.com/dex/theme/logo.png", false},
+		{proto.NetworkResourceTypeScript, "https://a.b.cdn.console.awsstatic.com/app.js", false},
+		{proto.NetworkResourceTypeScript, "https://www.googletagmanager.com/gtag/js", true},
+		{proto.NetworkResourceTypeXHR, "https://googletagmanager.com/collect", true},
+		{proto.NetworkResourceTypePing, "https://us-east-1.signin.aws/metrics", true},
+		{proto.NetworkResourceTypeDocument, "https://corp.awsapps.com/start", false},
+		{proto.NetworkResourceTypeImage, "data:image/png;base64,iVBORw0KGgo=", false},
+	} {
+		if got := ri.blocks(tt.typ, tt.url); got != tt.want {
+			t.Errorf("blocks(%s, %s) = %t, want %t", tt.typ, tt.url, got, tt.want)
+		}
+	}
+
+	if !matchHost([]string{"*.awsapps.com"}, "Corp.AWSApps.com") || matchHost([]string{"*.awsapps.com"}, "evilawsapps.com") {
+		t.Error("matchHost mismatches *.awsapps.com")
+	}
+}
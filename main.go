@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/charmbracelet/log"
 
@@ -17,7 +19,10 @@ const (
 	// on the redirect_uri query parameter (always present in the auth-code flow,
 	// and what the dex flow waits on) rather than a fixed host, so it works for
 	// any Dex instance — argocd or otherwise.
-	DexURLRegex    = `https?://[^\s'"]+[?&]redirect_uri=[^\s'"]+`
+	DexURLRegex = `https?://[^\s'"]+[?&]redirect_uri=[^\s'"]+`
+	// OIDCURLRegex also matches a loopback URL of the CLI's own listener,
+	// which redirects to the IdP (kubelogin prints http://localhost:8000).
+	OIDCURLRegex   = DexURLRegex + `|http://(?:localhost|127\.0\.0\.1|\[::1\])(?::[0-9]+)?(?:/[^\s'"]*)?`
 	DefaultTimeout = 30
 	// StdinURLSource is the flag value that tells a URL flag to read its URL
 	// from stdin instead of taking the value literally.
@@ -29,6 +34,7 @@ var (
 	deviceURLPattern           = regexp.MustCompile(DeviceURLRegex)
 	deviceURLValidationPattern = regexp.MustCompile("^" + DeviceURLRegex + "$")
 	dexURLPattern              = regexp.MustCompile(DexURLRegex)
+	oidcURLPattern             = regexp.MustCompile(OIDCURLRegex)
 )
 
 func main() {
@@ -44,92 +50,199 @@ and automatically filling in credentials using browser automation.
 Two flows are supported. The URL flow and source are always explicit: pass a
 literal URL, or '-' to read that flow's URL from stdin.
   • AWS device-code: --device-url <url>, or --device-url - to read from a pipe.
-  • Dex OIDC auth-code: --dex-url <url>, or --dex-url - to read from a pipe.
-    Useful for tools that log in through Dex backed by AWS IAM Identity Center,
-    e.g. 'argocd login --grpc-web <server> --sso --sso-launch-browser=false'.
+  • OIDC auth-code: --oidc-url <url>, or --oidc-url - to read from a pipe.
+    For CLIs that wait for the browser on a local redirect_uri: argocd and
+    other Dex clients, 'vault login -method=oidc', kubelogin, gcloud. --dex-url
+    is the same flow, reading only auth URLs from stdin.
+    With --oob the login ends on a page showing a code, which is printed;
+    --oob-exec '<command>' runs the CLI and types the code into it.
 
 Usage:
   aws sso login --sso-session <session> --no-browser | awsssologin --device-url -
   argocd login --grpc-web <server> --sso --sso-launch-browser=false 2>&1 | awsssologin --dex-url -
-  awsssologin --dex-url '<dex auth URL printed by the CLI>'
+  vault login -method=oidc skip_browser=true 2>&1 | awsssologin --oidc-url -
+  awsssologin --oidc-url '<auth URL printed by the CLI>'
 
 Credentials can be provided via:
-1. Command line flags (highest priority)
-2. Environment variables (AWSSSOLOGIN_USERNAME, AWSSSOLOGIN_PASSWORD, AWSSSOLOGIN_2FA, AWSSSOLOGIN_TOTP_SECRET)
-3. Interactive prompts (lowest priority). Works only with --device-url flag!`,
+1. Command line flags (highest priority), including secrets read from file descriptors
+   (--password-fd, --totp-secret-fd, --credentials-fd)
+2. Environment variables (AWSSSOLOGIN_USERNAME, AWSSSOLOGIN_PASSWORD, AWSSSOLOGIN_2FA, AWSSSOLOGIN_TOTP_SECRET, AWSSSOLOGIN_2FA_CMD)
+3. The config file identity (--config, --identity)
+4. Interactive prompts on the terminal (lowest priority), also when the URL is piped in`,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			logLevel, err := log.ParseLevel(config.LogLevel)
-			if err != nil {
-				return fmt.Errorf("invalid log level: %v", err)
+			if err := config.applyLogLevel(); err != nil {
+				return err
 			}
-			log.SetLevel(logLevel)
-			return runSSO(&config)
+			config.flags = cmd.Flags()
+			return runSSO(cmd.Context(), &config)
 		},
 	}
 
 	rootCmd.SetVersionTemplate("{{.Name}} {{.Version}}\n")
 
-	rootCmd.Flags().StringVarP(&config.Username, "username", "u", "", "AWS SSO username")
-	rootCmd.Flags().StringVarP(&config.Password, "password", "p", "", "AWS SSO password")
-	rootCmd.Flags().StringVarP(&config.TwoFA, "2fa", "", "", "AWS SSO 2FA code")
-	rootCmd.Flags().
-		StringVarP(&config.TOTPSecret, "totp-secret", "t", "", "TOTP secret key for 2FA (if not provided, you'll be prompted to enter TOTP interactively)")
-	rootCmd.Flags().
+	rootCmd.PersistentFlags().StringVarP(&config.Username, "username", "u", "", "AWS SSO username")
+	rootCmd.PersistentFlags().VarP(&config.Password, "password", "p", "AWS SSO password")
+	rootCmd.PersistentFlags().VarP(&config.TwoFA, "2fa", "", "AWS SSO 2FA code")
+	rootCmd.PersistentFlags().
+		VarP(&config.TOTPSecret, "totp-secret", "t", "TOTP secret key for 2FA (if not provided, you'll be prompted to enter TOTP interactively)")
+	rootCmd.PersistentFlags().
+		IntVar(&config.PasswordFD, "password-fd", -1, "Read the password from this file descriptor (e.g. 3<<<\"$password\")")
+	rootCmd.PersistentFlags().
+		IntVar(&config.TOTPSecretFD, "totp-secret-fd", -1, "Read the TOTP secret from this file descriptor")
+	rootCmd.PersistentFlags().
+		IntVar(&config.CredentialsFD, "credentials-fd", -1, "Read a JSON credentials document (username, password, 2fa, totp_secret) from this file descriptor")
+	rootCmd.PersistentFlags().
+		BoolVar(&config.ForbidArgvSecrets, "forbid-argv-secrets", false, "Fail instead of warning when --password or --totp-secret is passed on the command line")
+	rootCmd.PersistentFlags().
+		StringVar(&config.TwoFACmd, "2fa-cmd", "", "Command run when the MFA field appears; its trimmed stdout is used as the 2FA code")
+	rootCmd.PersistentFlags().
+		IntVar(&config.TwoFACmdTimeoutSeconds, "2fa-cmd-timeout", DefaultTwoFACmdTimeout, "Timeout in seconds for a single --2fa-cmd run")
+	rootCmd.PersistentFlags().
+		StringVar(&config.PromptBackend, "prompt-backend", PromptBackendTTY, "How to prompt for missing credentials: tty, pinentry, stdin")
+	rootCmd.PersistentFlags().
+		StringVar(&config.PinentryProgram, "pinentry-program", DefaultPinentryProgram, "pinentry binary used by --prompt-backend pinentry")
+	rootCmd.PersistentFlags().
 		StringVar(&config.DeviceURL, "device-url", "", "AWS SSO device URL, or '-' to read it from stdin (e.g. piped from 'aws sso login --no-browser')")
-	rootCmd.Flags().
+	rootCmd.PersistentFlags().
 		StringVar(&config.DexURL, "dex-url", "", "Dex OIDC auth URL for the auth-code flow (e.g. 'argocd login --sso --sso-launch-browser=false'), or '-' to read it from stdin; mutually exclusive with --device-url")
-	rootCmd.Flags().
+	rootCmd.PersistentFlags().
+		BoolVar(&config.OOB, "oob", false, "The auth-code login ends on a page showing a code to paste into the CLI: print the code (implied by redirect_uri "+RedirectURIOOB+")")
+	rootCmd.PersistentFlags().
+		StringVar(&config.OOBExec, "oob-exec", "", "Command that prints an out-of-band auth URL and reads the code from stdin, e.g. kubelogin with --grant-type authcode-keyboard; the code is typed into it")
+	rootCmd.PersistentFlags().
+		StringVar(&config.OOBCodeXPath, "oob-code-xpath", "", "XPath of the element showing the out-of-band code (default: Dex's code page, else the code in the redirect_uri's query)")
+	rootCmd.PersistentFlags().
+		StringVar(&config.DexURL, "oidc-url", "", "OIDC auth URL, or loopback URL of the CLI's listener, for the auth-code flow (e.g. 'vault login -method=oidc', kubelogin), or '-' to read it from stdin; mutually exclusive with --device-url and --dex-url")
+	rootCmd.PersistentFlags().
 		BoolVar(&config.ShowBrowser, "show-browser", false, "Show browser window (runs headless by default)")
-	rootCmd.Flags().
+	rootCmd.PersistentFlags().
+		StringVar(&config.BrowserBin, "browser-bin", "", "Browser binary to launch (path or name in PATH); by default a downloaded Chromium, else the system Chrome, Chromium or Edge")
+	rootCmd.PersistentFlags().
+		StringArrayVar(&config.BrowserFlags, "browser-flag", nil, "Extra browser command-line flag, 'name' or 'name=value' (repeatable), e.g. proxy-server=http://proxy:3128")
+	rootCmd.PersistentFlags().
+		BoolVar(&config.Offline, "offline", false, "Never download Chromium; fail at once if no browser is installed")
+	rootCmd.PersistentFlags().
+		BoolVar(&config.BlockRequests, "block-requests", true, "Block images, fonts and analytics the login doesn't need (--block-requests=false to load everything)")
+	rootCmd.PersistentFlags().
+		BoolVar(&config.RelayCallback, "relay-callback", false, "Relay the Dex callback to the CLI's local listener from this process instead of the browser (default on with --browser-ws/--browser-url)")
+	rootCmd.PersistentFlags().
+		StringVar(&config.DexConnector, "dex-connector", "", "Connector to click on Dex's 'Log in with...' chooser, by ID or name")
+	rootCmd.PersistentFlags().
+		StringArrayVar(&config.DexApproveClients, "dex-approve-client", nil, "Client ID to grant access on Dex's approval screen (repeatable); other clients are refused")
+	rootCmd.PersistentFlags().
+		StringVar(&config.Proxy, "proxy", "", "Proxy for the browser, e.g. http://proxy:3128 or socks5://host:1080 ('direct' ignores HTTPS_PROXY); defaults to HTTPS_PROXY/HTTP_PROXY")
+	rootCmd.PersistentFlags().
+		StringVar(&config.ProxyPAC, "proxy-pac", "", "PAC file URL the browser picks its proxy with; mutually exclusive with --proxy")
+	rootCmd.PersistentFlags().
+		StringVar(&config.ProxyUser, "proxy-user", "", "Proxy user name, if the proxy URL has none; the password comes from the URL or AWSSSOLOGIN_PROXY_PASSWORD")
+	rootCmd.PersistentFlags().
+		StringVar(&config.CAFile, "ca-file", "", "PEM file of CA certificates the browser trusts for this login, e.g. a TLS-inspecting proxy's")
+	rootCmd.PersistentFlags().
+		StringVar(&config.BrowserWS, "browser-ws", "", "DevTools websocket URL of a running browser to use instead of launching one (e.g. ws://chrome:3000)")
+	rootCmd.PersistentFlags().
+		StringVar(&config.BrowserURL, "browser-url", "", "DevTools HTTP endpoint of a running browser to use instead of launching one (e.g. http://localhost:9222)")
+	rootCmd.PersistentFlags().
+		BoolVar(&config.PersistSession, "persist-session", false, "Keep an encrypted browser profile per identity so a live SSO session skips credential entry")
+	rootCmd.PersistentFlags().
+		BoolVar(&config.FreshSession, "fresh-session", false, "Discard the stored browser profile for this identity before logging in")
+	rootCmd.PersistentFlags().
 		IntVar(&config.TimeoutSeconds, "timeout", DefaultTimeout, "Timeout in seconds for browser operations")
-	rootCmd.Flags().
+	rootCmd.PersistentFlags().
+		IntVar(&config.DeadlineSeconds, "deadline", 0, "Total time in seconds the whole run may take, prompts included (0 for no limit)")
+	rootCmd.PersistentFlags().
 		StringVar(&config.DebugDir, "debug-dir", "", "Directory to write failure debug dumps (HTML, screenshot, info); defaults to the OS temp dir")
-	rootCmd.Flags().
+	rootCmd.PersistentFlags().
 		StringVar(&config.LogLevel, "log-level", "info", "Log level: debug, info, warn, error")
+	rootCmd.PersistentFlags().
+		StringVar(&config.ConfigFile, "config", "", "Config file with named identities (default ~/.config/awsssologin/config.yaml)")
+	rootCmd.PersistentFlags().
+		StringVar(&config.Identity, "identity", "", "Config file identity to use instead of matching one by URL or sso-session")
+	rootCmd.PersistentFlags().
+		StringVar(&config.SSOSession, "sso-session", "", "sso-session name being logged into, used to pick a config file identity")
 
-	if err := rootCmd.Execute(); err != nil {
+	// Subcommands share the login flags so they see the same merged config.
+	rootCmd.AddCommand(newConfigCmd(&config))
+	rootCmd.AddCommand(newDoctorCmd(&config))
+	rootCmd.AddCommand(newBatchCmd(&config))
+
+	// SIGINT and SIGTERM cancel the run, which then cleans up and exits with
+	// the shell's code for the signal.
+	ctx, stop := interruptContext()
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if e, ok := interrupted(ctx); ok {
+		os.Exit(e.exitCode())
+	}
+	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 }
 
-func runSSO(config *Config) error {
+func runSSO(ctx context.Context, config *Config) (err error) {
 	log.Info("Starting AWS SSO login automation...")
 
 	// Step 0: Validate configuration and set defaults
 	if err := config.ValidateConfig(); err != nil {
 		return fmt.Errorf("configuration validation failed: %v", err)
 	}
+	if err := config.checkOffline(); err != nil {
+		return err
+	}
+	ctx, cancel := config.withDeadline(ctx)
+	defer cancel()
+
+	// The browser starts while the URL is read and credentials are resolved.
+	// If the login never gets to use it, it is closed on the way out.
+	warm := prelaunchBrowser(ctx, config)
+	defer warm.discard()
 
 	var (
 		deviceURL string
 		scanner   *bufio.Scanner
-		err       error
+		child     *oobChild
 	)
+	// An --oob-exec command is killed unless it was given its code.
+	defer func() {
+		if child != nil {
+			_ = child.finish(false)
+		}
+	}()
 
-	// Step 1: Get credentials
-	if err := getCredentials(config); err != nil {
-		return fmt.Errorf("failed to get credentials: %v", err)
-	}
+	// Secrets are wiped from memory once we're done.
+	defer config.wipeSecrets()
 
-	// Step 2: Get the login URL. The flow (dex vs device) and the source (stdin
+	// Step 1: Get the login URL. The flow (dex vs device) and the source (stdin
 	// vs literal) are both declared explicitly by the flags: a value of "-" means
 	// "read this flow's URL from stdin". Only a stdin path keeps a scanner so the
 	// upstream CLI's output can be drained on success. When the URL is read from
 	// stdin its flow flag is rewritten to the resolved URL so downstream steps
-	// (e.g. dexCallbackPrefix) see the real value.
+	// (e.g. oidcCallbackFor) see the real value.
 	switch {
+	case config.OOBExec != "":
+		if child, err = startOOBChild(ctx, config.OOBExec); err != nil {
+			return err
+		}
+		deviceURL, err = child.waitURL(ctx, time.Duration(config.TimeoutSeconds)*time.Second)
+		if err != nil {
+			return err
+		}
+		config.DexURL = deviceURL
 	case config.DexURL == StdinURLSource:
-		deviceURL, scanner, err = readURLFromStdin(dexURLPattern, "Dex")
+		pattern, kind := dexURLPattern, "Dex"
+		if config.flagChanged("oidc-url") {
+			pattern, kind = oidcURLPattern, "OIDC"
+		}
+		deviceURL, scanner, err = readURLFromStdin(ctx, pattern, kind)
 		if err != nil {
 			return fmt.Errorf("failed to process stdin: %v", err)
 		}
 		config.DexURL = deviceURL
 	case config.DexURL != "":
 		deviceURL = config.DexURL
-		log.Info("Using Dex auth URL from command line", "url", deviceURL)
+		log.Info("Using auth URL from command line", "url", deviceURL, "flag", "--"+config.authCodeFlag())
 	case config.DeviceURL == StdinURLSource:
-		deviceURL, scanner, err = readURLFromStdin(deviceURLPattern, "device")
+		deviceURL, scanner, err = readURLFromStdin(ctx, deviceURLPattern, "device")
 		if err != nil {
 			return fmt.Errorf("failed to process stdin: %v", err)
 		}
@@ -138,8 +251,35 @@ func runSSO(config *Config) error {
 		log.Info("Using device URL from command line", "url", deviceURL)
 	}
 
-	// Step 3: Automate browser login
-	if err := automateBrowserLogin(deviceURL, config); err != nil {
+	// Step 2: Pick the ~/.aws/config sso-session and the config file identity
+	// by URL if they couldn't be chosen before the URL was known.
+	if err := config.applyURLSettings(deviceURL); err != nil {
+		return fmt.Errorf("failed to select settings: %v", err)
+	}
+
+	// Step 3: One login per session at a time. A login that waited for a
+	// concurrent one of the same session may not need the browser at all.
+	lock, previous, err := acquireSessionLock(ctx, config, deviceURL)
+	if err != nil {
+		return fmt.Errorf("failed to lock session: %v", err)
+	}
+	defer func() { lock.release(err, config.rejected) }()
+	if previous != nil {
+		if done, err := afterConcurrentLogin(previous, config, deviceURL); done {
+			if err == nil && scanner != nil {
+				log.Warn("The CLI piping into awsssologin still waits for its own device code and can be interrupted")
+			}
+			return err
+		}
+	}
+
+	// Step 4: Get credentials
+	if err := getCredentials(ctx, config); err != nil {
+		return fmt.Errorf("failed to get credentials: %v", err)
+	}
+
+	// Step 5: Automate browser login
+	if err := automateBrowserLogin(ctx, deviceURL, config, warm); err != nil {
 		// Fail fast: do NOT drain stdin here. The upstream "aws sso login
 		// --use-device-code" keeps polling CreateToken until the device code
 		// expires (~10 min), so draining would block reporting this error for
@@ -147,6 +287,20 @@ func runSSO(config *Config) error {
 		return fmt.Errorf("browser automation failed: %v", err)
 	}
 
+	// Out of band, the code is typed into the --oob-exec command, or printed
+	// to be pasted into the CLI.
+	if config.outOfBand() {
+		if child != nil {
+			c := child
+			child = nil
+			if err := c.enterCode(config.OOBCode); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println(config.OOBCode.Reveal())
+		}
+	}
+
 	// On success, drain the remaining AWS CLI output so it can finish writing
 	// the token without a broken pipe.
 	if scanner != nil {
@@ -173,30 +327,41 @@ func continueReadingStdin(scanner *bufio.Scanner) {
 // readURLFromStdin scans stdin line by line for the first URL matching pattern
 // and returns it along with the still-open scanner so the caller can drain the
 // rest of the upstream CLI's output on success. kind is used only for logging
-// and error messages ("device", "Dex").
-func readURLFromStdin(pattern *regexp.Regexp, kind string) (string, *bufio.Scanner, error) {
+// and error messages ("device", "Dex"). A read blocked on stdin is abandoned
+// when ctx is done.
+func readURLFromStdin(ctx context.Context, pattern *regexp.Regexp, kind string) (string, *bufio.Scanner, error) {
 	log.Info("Reading CLI output from stdin to find URL...", "kind", kind)
 
 	scanner := bufio.NewScanner(os.Stdin)
 
-	var found string
-	for scanner.Scan() {
-		line := scanner.Text()
+	found := make(chan string, 1)
+	go func() {
+		defer close(found)
+		for scanner.Scan() {
+			line := scanner.Text()
 
-		if match := pattern.FindString(line); match != "" {
-			log.Info("URL found from stdin", "kind", kind, "url", match)
-			found = match
-			break // Stop reading; the upstream CLI is now blocked waiting on us.
+			if match := pattern.FindString(line); match != "" {
+				log.Info("URL found from stdin", "kind", kind, "url", match)
+				found <- match
+				return // Stop reading; the upstream CLI is now blocked waiting on us.
+			}
 		}
+	}()
+
+	var match string
+	select {
+	case match = <-found:
+	case <-ctx.Done():
+		return "", nil, fmt.Errorf("stopped reading stdin: %v", context.Cause(ctx))
 	}
 
 	if err := scanner.Err(); err != nil {
 		return "", nil, fmt.Errorf("error reading from stdin: %v", err)
 	}
 
-	if found == "" {
+	if match == "" {
 		return "", nil, fmt.Errorf("%s URL not found in stdin output", kind)
 	}
 
-	return found, scanner, nil
+	return match, scanner, nil
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-rod/rod"
+)
+
+// oidcCallback is where an OAuth auth-code login ends: the CLI's redirect_uri,
+// e.g. http://localhost:8085/auth/callback (argocd),
+// http://localhost:8250/oidc/callback (vault) or http://localhost:8085/
+// (gcloud). The browser may pass through any number of IdP hosts on the way.
+type oidcCallback struct {
+	origin string // scheme and host, e.g. http://127.0.0.1:8250
+	path   string // never empty: "/" for a bare origin
+	// needsCode is set when the login starts on the listener itself
+	// (kubelogin's http://localhost:8000), so only a return carrying the
+	// authorization response counts.
+	needsCode bool
+	// codeXPath, out of band, matches the code shown on the last page; the
+	// origin is then empty if the redirect_uri isn't a URL (see oob.go).
+	codeXPath string
+}
+
+// oidcCallbackFor works out the callback of an auth URL: its redirect_uri or,
+// for a loopback URL of the CLI's own listener that redirects to the IdP,
+// that URL. The port is taken from the URL itself so it tracks whatever local
+// port the CLI chose.
+func oidcCallbackFor(authURL string) (oidcCallback, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return oidcCallback{}, fmt.Errorf("could not parse auth URL: %v", err)
+	}
+	target, needsCode := u, true
+	if redirect := u.Query().Get("redirect_uri"); redirect != "" {
+		if target, err = url.Parse(redirect); err != nil {
+			return oidcCallback{}, fmt.Errorf("could not parse redirect_uri %q: %v", redirect, err)
+		}
+		needsCode = false
+	} else if !isLoopbackURL(u) {
+		return oidcCallback{}, fmt.Errorf("auth URL has no redirect_uri query parameter")
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return oidcCallback{}, fmt.Errorf("redirect_uri %q is not an absolute URL", target)
+	}
+	return oidcCallback{
+		origin:    target.Scheme + "://" + target.Host,
+		path:      callbackPath(target),
+		needsCode: needsCode,
+	}, nil
+}
+
+func callbackPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+func (c oidcCallback) String() string {
+	if c.origin == "" {
+		return "the authorization code page"
+	}
+	return c.origin + c.path
+}
+
+// matches reports whether the browser has reached the callback: same origin
+// and path, whatever the query. An IdP page on the same origin (e.g. Vault's
+// UI next to its callback) doesn't count.
+func (c oidcCallback) matches(rawURL string) bool {
+	if c.origin == "" {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(u.Scheme+"://"+u.Host, c.origin) || callbackPath(u) != c.path {
+		return false
+	}
+	if !c.needsCode {
+		return true
+	}
+	q := u.Query()
+	return q.Has("code") || q.Has("error")
+}
+
+// atCallback passes once the main frame has reached the callback, even if
+// the listener redirected it on, e.g. gcloud's to a page on cloud.google.com.
+// Out of band it also passes once the page shows the code.
+func (w *pageWatch) atCallback(c oidcCallback) pageCheck {
+	return func(p *rod.Page) (bool, error) {
+		if _, ok := w.passedThrough(c.matches); ok {
+			return true, nil
+		}
+		if c.codeXPath == "" {
+			return false, nil
+		}
+		return hasX(c.codeXPath)(p)
+	}
+}
+
+// isLoopbackURL reports whether u is a plain-http URL on this host, where
+// CLIs run their callback listener.
+func isLoopbackURL(u *url.URL) bool {
+	if u.Scheme != "http" {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestOIDCCallback checks which browser URLs count as the callback of the
+// auth URLs of several CLIs, and that their stdin lines are recognised.
+func TestOIDCCallback(t *testing.T) {
+	tests := []struct {
+		name, line, authURL string
+		reached, notReached []string
+	}{{
+		name:       "argocd",
+		line:       "Performing authorization_code flow login: https://argocd.example.com/api/dex/auth?client_id=argo-cd-cli&redirect_uri=http%3A%2F%2Flocalhost%3A8085%2Fauth%2Fcallback&state=x",
+		authURL:    "https://argocd.example.com/api/dex/auth?client_id=argo-cd-cli&redirect_uri=http%3A%2F%2Flocalhost%3A8085%2Fauth%2Fcallback&state=x",
+		reached:    []string{"http://localhost:8085/auth/callback?code=abc&state=x"},
+		notReached: []string{"http://localhost:8085/", "http://localhost:8086/auth/callback?code=abc", "https://argocd.example.com/auth/callback"},
+	}, {
+		name:       "vault",
+		line:       "    https://vault.example.com/ui/vault/identity/oidc/provider/default/authorize?client_id=c&redirect_uri=http%3A%2F%2F127.0.0.1%3A8250%2Foidc%2Fcallback&scope=openid",
+		authURL:    "https://vault.example.com/ui/vault/identity/oidc/provider/default/authorize?client_id=c&redirect_uri=http%3A%2F%2F127.0.0.1%3A8250%2Foidc%2Fcallback&scope=openid",
+		reached:    []string{"http://127.0.0.1:8250/oidc/callback?code=abc&state=x"},
+		notReached: []string{"http://127.0.0.1:8250/oidc/callbacks?code=abc", "http://127.0.0.1:8250/ui/vault/auth"},
+	}, {
+		name:       "gcloud",
+		line:       "Go to the following link in your browser: https://accounts.google.com/o/oauth2/auth?response_type=code&client_id=c&redirect_uri=http%3A%2F%2Flocalhost%3A8085%2F&scope=openid",
+		authURL:    "https://accounts.google.com/o/oauth2/auth?response_type=code&client_id=c&redirect_uri=http%3A%2F%2Flocalhost%3A8085%2F&scope=openid",
+		reached:    []string{"http://localhost:8085/?state=x&code=abc", "http://localhost:8085?code=abc"},
+		notReached: []string{"http://localhost:8085/favicon.ico"},
+	}, {
+		name:       "kubelogin",
+		line:       "Please visit the following URL in your browser: http://localhost:8000",
+		authURL:    "http://localhost:8000",
+		reached:    []string{"http://localhost:8000/?code=abc&state=x", "http://localhost:8000/?error=access_denied"},
+		notReached: []string{"http://localhost:8000", "http://localhost:8000/"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := oidcURLPattern.FindString(tt.line); got != tt.authURL {
+				t.Errorf("URL found in %q = %q", tt.line, got)
+			}
+			if err := validateDexURL(tt.authURL); err != nil {
+				t.Errorf("validateDexURL: %v", err)
+			}
+			callback, err := oidcCallbackFor(tt.authURL)
+			if err != nil {
+				t.Fatalf("oidcCallbackFor: %v", err)
+			}
+			for _, u := range tt.reached {
+				if !callback.matches(u) {
+					t.Errorf("%s doesn't reach callback %s", u, callback)
+				}
+			}
+			for _, u := range tt.notReached {
+				if callback.matches(u) {
+					t.Errorf("%s counts as callback %s", u, callback)
+				}
+			}
+		})
+	}
+
+	if _, err := oidcCallbackFor("https://idp.example.com/authorize?client_id=c"); err == nil {
+		t.Error("a non-loopback URL without redirect_uri has a callback")
+	}
+
+	// A callback that redirects on is reached all the same.
+	callback, _ := oidcCallbackFor(tests[2].authURL)
+	w := newPageWatch(context.Background())
+	w.navigated("https://accounts.google.com/signin")
+	w.redirected("http://localhost:8085/?code=abc")
+	w.navigated("https://cloud.google.com/sdk/auth_success")
+	if _, err := w.wait(time.Second, "the callback", w.atCallback(callback)); err != nil {
+		t.Errorf("callback redirected on: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// RedirectURIOOB is the redirect_uri of OAuth's out-of-band flow: the IdP
+	// shows the authorization code instead of redirecting.
+	RedirectURIOOB = "urn:ietf:wg:oauth:2.0:oob"
+	// XPathOOBCode matches the code on Dex's out-of-band page ("Login
+	// Successful ... paste it there").
+	XPathOOBCode = `//div[h2[contains(., "Login Successful")]]//input[@value]`
+)
+
+// outOfBand reports whether the auth-code login ends on a page showing the
+// code rather than at the CLI's listener: with --oob or --oob-exec, or for
+// the out-of-band redirect_uri.
+func (c *Config) outOfBand() bool {
+	if c.OOB || c.OOBExec != "" {
+		return true
+	}
+	u, err := url.Parse(c.DexURL)
+	return err == nil && u.Query().Get("redirect_uri") == RedirectURIOOB
+}
+
+// loginCallback is where the auth-code login ends. Out of band, that is the
+// redirect_uri with a code in its query (gcloud's authcode.html), or the page
+// showing the code: Dex's, or --oob-code-xpath.
+func (c *Config) loginCallback() (oidcCallback, error) {
+	if !c.outOfBand() {
+		return oidcCallbackFor(c.DexURL)
+	}
+	callback := oidcCallback{codeXPath: c.OOBCodeXPath}
+	if callback.codeXPath == "" {
+		callback.codeXPath = XPathOOBCode
+	}
+	u, err := url.Parse(c.DexURL)
+	if err != nil {
+		return oidcCallback{}, fmt.Errorf("could not parse auth URL: %v", err)
+	}
+	if r, err := url.Parse(u.Query().Get("redirect_uri")); err == nil && r.Host != "" {
+		callback.origin = r.Scheme + "://" + r.Host
+		callback.path = callbackPath(r)
+		callback.needsCode = true
+	}
+	return callback, nil
+}
+
+// captureOOBCode reads the authorization code of an out-of-band login that
+// has reached its callback: from the callback's code query parameter, else
+// from the page.
+func captureOOBCode(w *pageWatch, config *Config, timeout time.Duration) error {
+	callback, err := config.loginCallback()
+	if err != nil {
+		return err
+	}
+
+	code := ""
+	if rawURL, ok := w.passedThrough(callback.matches); ok {
+		if u, err := url.Parse(rawURL); err == nil {
+			code = u.Query().Get("code")
+			if e := u.Query().Get("error"); code == "" && e != "" {
+				return fmt.Errorf("the IdP returned error %q instead of a code", e)
+			}
+		}
+	}
+	if code == "" {
+		el, err := findElement(w, callback.codeXPath, "authorization code", timeout)
+		if err != nil {
+			return err
+		}
+		if value, err := el.Attribute("value"); err == nil && value != nil {
+			code = *value
+		}
+		if strings.TrimSpace(code) == "" {
+			if code, err = el.Text(); err != nil {
+				return fmt.Errorf("failed to read the authorization code: %v", err)
+			}
+		}
+	}
+
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return fmt.Errorf("the page shows no authorization code")
+	}
+	config.OOBCode = NewSecret(code)
+	log.Info("Captured the authorization code")
+	return nil
+}
+
+// oobChild is the --oob-exec command: a CLI that prints the auth URL and
+// then reads the code from stdin. Its stdout and stderr are forwarded to
+// ours and both scanned for the URL.
+type oobChild struct {
+	*batchChild
+	stdin io.WriteCloser
+}
+
+// startOOBChild starts the --oob-exec command, which is killed once ctx is
+// done.
+func startOOBChild(ctx context.Context, line string) (*oobChild, error) {
+	cmd := shellCommand(ctx, line)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Plain pipes rather than StdoutPipe: the command is waited for apart
+	// from its output, which a grandchild may hold open.
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = outW, errW
+	err = cmd.Start()
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		outR.Close()
+		errR.Close()
+		return nil, fmt.Errorf("failed to start %q: %v", line, err)
+	}
+	log.Info("Started command", "command", line)
+
+	c := &oobChild{
+		batchChild: &batchChild{cmd: cmd, urls: make(chan string, 1), done: make(chan error, 1)},
+		stdin:      stdin,
+	}
+	go func() { c.done <- cmd.Wait() }()
+
+	found := make(chan string, 2)
+	forward := func(r *os.File, to io.Writer) {
+		defer r.Close()
+		sent := false
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			text := scanner.Text()
+			fmt.Fprintln(to, text)
+			if u := dexURLPattern.FindString(text); u != "" && !sent {
+				sent = true
+				found <- u
+			}
+		}
+		if !sent {
+			found <- ""
+		}
+	}
+	go forward(outR, os.Stdout)
+	go forward(errR, os.Stderr)
+	go func() {
+		// The first URL from either stream; none once both have ended.
+		for range 2 {
+			if u := <-found; u != "" {
+				c.urls <- u
+				return
+			}
+		}
+		close(c.urls)
+	}()
+	return c, nil
+}
+
+// enterCode writes the code to the command's stdin, as if typed, and lets it
+// finish its login.
+func (c *oobChild) enterCode(code Secret) error {
+	_, err := io.WriteString(c.stdin, code.Reveal()+"\n")
+	c.stdin.Close()
+	if err != nil {
+		_ = c.finish(false)
+		return fmt.Errorf("failed to enter the code into the command: %v", err)
+	}
+	return c.finish(true)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOutOfBandCode checks where an out-of-band login's code is read from,
+// and that --oob-exec's command gets it on stdin.
+func TestOutOfBandCode(t *testing.T) {
+	const kubeloginURL = "https://dex.example.com/dex/auth?client_id=kubernetes&redirect_uri=urn%3Aietf%3Awg%3Aoauth%3A2.0%3Aoob&response_type=code"
+	config := &Config{DexURL: kubeloginURL}
+	callback, err := config.loginCallback()
+	if !config.outOfBand() || err != nil || callback.codeXPath != XPathOOBCode || callback.matches("https://dex.example.com/dex/approval?code=x") {
+		t.Errorf("out-of-band redirect_uri gives callback %+v, %v", callback, err)
+	}
+
+	// gcloud: the code is in the query of its authcode.html page.
+	config = &Config{OOB: true, DexURL: "https://accounts.google.com/o/oauth2/auth?client_id=c&redirect_uri=https%3A%2F%2Fsdk.cloud.google.com%2Fauthcode.html&response_type=code"}
+	w := newPageWatch(t.Context())
+	w.navigated("https://sdk.cloud.google.com/authcode.html?state=x&code=4%2F0Aabc")
+	if err := captureOOBCode(w, config, time.Second); err != nil || config.OOBCode.Reveal() != "4/0Aabc" {
+		t.Errorf("captured %q, %v; want 4/0Aabc", config.OOBCode.Reveal(), err)
+	}
+	w.navigated("https://sdk.cloud.google.com/authcode.html?error=access_denied")
+	if err := captureOOBCode(w, config, time.Second); err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("capture after an IdP error = %v", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("test commands use POSIX sh syntax")
+	}
+	child, err := startOOBChild(t.Context(), "echo 'Please visit: "+kubeloginURL+"' >&2; printf 'Enter code: '; read code; test \"$code\" = 4/0Aabc")
+	if err != nil {
+		t.Fatalf("startOOBChild: %v", err)
+	}
+	if u, err := child.waitURL(t.Context(), 5*time.Second); u != kubeloginURL || err != nil {
+		t.Errorf("waitURL = %q, %v", u, err)
+	}
+	if err := child.enterCode(NewSecret("4/0Aabc")); err != nil {
+		t.Errorf("enterCode: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DefaultPinentryProgram is the pinentry binary used by --prompt-backend
+// pinentry. Distributions point it at their preferred variant (curses, gtk,
+// qt, tty, mac).
+const DefaultPinentryProgram = "pinentry"
+
+// pinentryClient is a minimal Assuan client for talking to a pinentry
+// process, the same protocol gpg-agent uses. Only what is needed to show one
+// prompt and read one PIN is implemented.
+type pinentryClient struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// startPinentry starts program and waits for its Assuan greeting.
+func startPinentry(ctx context.Context, program string) (*pinentryClient, error) {
+	cmd := exec.CommandContext(ctx, program)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", program, err)
+	}
+
+	p := &pinentryClient{cmd: cmd, in: in, out: bufio.NewReader(out)}
+	if _, err := p.response(); err != nil {
+		p.close()
+		return nil, fmt.Errorf("%s did not greet: %v", program, err)
+	}
+	return p, nil
+}
+
+// command sends one Assuan request line and returns the decoded data lines of
+// the response.
+func (p *pinentryClient) command(line string) (string, error) {
+	if _, err := fmt.Fprintf(p.in, "%s\n", line); err != nil {
+		return "", err
+	}
+	return p.response()
+}
+
+// response reads response lines until OK or ERR, collecting "D" data lines.
+// Status ("S") and comment ("#") lines are ignored.
+func (p *pinentryClient) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := p.out.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("reading pinentry response: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", fmt.Errorf("pinentry: %s", strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			decoded, err := assuanUnescape(strings.TrimPrefix(line, "D "))
+			if err != nil {
+				return "", err
+			}
+			data.WriteString(decoded)
+		}
+	}
+}
+
+// close says goodbye and reaps the process. Errors are irrelevant by then.
+func (p *pinentryClient) close() {
+	_, _ = fmt.Fprintln(p.in, "BYE")
+	p.in.Close()
+	_ = p.cmd.Wait()
+}
+
+// pinentryGetPin shows a single pinentry dialog with the given prompt and
+// returns what the user entered. A cancelled dialog is an error.
+func pinentryGetPin(ctx context.Context, program string, prompt string) (string, error) {
+	p, err := startPinentry(ctx, program)
+	if err != nil {
+		return "", err
+	}
+	defer p.close()
+
+	// Curses/tty variants need to know which terminal to draw on: their own
+	// stdin/stdout are our pipes. GPG_TTY follows the gpg convention.
+	setup := []string{"SETTITLE awsssologin", "SETPROMPT " + assuanEscape(prompt)}
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		setup = append(setup, "OPTION ttyname="+assuanEscape(tty))
+	} else if ttyAvailable() {
+		setup = append(setup, "OPTION ttyname=/dev/tty")
+	}
+	if termType := os.Getenv("TERM"); termType != "" {
+		setup = append(setup, "OPTION ttytype="+assuanEscape(termType))
+	}
+	for _, line := range setup {
+		if _, err := p.command(line); err != nil {
+			return "", err
+		}
+	}
+
+	return p.command("GETPIN")
+}
+
+// assuanEscape percent-encodes the characters that can't appear literally in
+// an Assuan line.
+func assuanEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch c {
+		case '%', '\r', '\n':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// assuanUnescape decodes the %XX sequences in an Assuan data line.
+func assuanUnescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated escape in pinentry data")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in pinentry data: %v", err)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakePinentry speaks just enough Assuan to stand in for pinentry: it logs
+// every request to $FAKE_PINENTRY_LOG and answers GETPIN with an escaped PIN,
+// or with a cancellation when $FAKE_PINENTRY_CANCEL is set.
+const fakePinentry = `#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r line; do
+  echo "$line" >> "$FAKE_PINENTRY_LOG"
+  case "$line" in
+    GETPIN)
+      if [ -n "$FAKE_PINENTRY_CANCEL" ]; then
+        echo "ERR 83886179 Operation cancelled <Pinentry>"
+      else
+        echo "S PASSWORD_FROM_CACHE"
+        echo "D p%25ss w0rd"
+        echo "OK"
+      fi ;;
+    BYE) echo "OK closing connection"; exit 0 ;;
+    *) echo "OK" ;;
+  esac
+done
+`
+
+func TestPinentryGetPin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake pinentry is a POSIX shell script")
+	}
+
+	dir := t.TempDir()
+	program := filepath.Join(dir, "pinentry")
+	if err := os.WriteFile(program, []byte(fakePinentry), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "requests.log")
+	t.Setenv("FAKE_PINENTRY_LOG", logPath)
+	t.Setenv("GPG_TTY", "/dev/pts/9")
+
+	pin, err := pinentryGetPin(t.Context(), program, "Enter 100% of the code")
+	if err != nil {
+		t.Fatalf("pinentryGetPin: %v", err)
+	}
+	if pin != "p%ss w0rd" {
+		t.Errorf("pin = %q, want %q", pin, "p%ss w0rd")
+	}
+
+	requests, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SETPROMPT Enter 100%25 of the code", "OPTION ttyname=/dev/pts/9", "GETPIN", "BYE"} {
+		if !strings.Contains(string(requests), want+"\n") {
+			t.Errorf("pinentry never received %q; got:\n%s", want, requests)
+		}
+	}
+
+	t.Setenv("FAKE_PINENTRY_CANCEL", "1")
+	if _, err := pinentryGetPin(t.Context(), program, "Enter code"); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("expected a cancellation error, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// browserPrelaunch is a browser launched in the background while the login
+// URL is read and credentials are resolved, so the login finds it warm.
+type browserPrelaunch struct {
+	key     string // launchKey of the settings it was launched with
+	started time.Time
+	done    chan struct{}
+	taken   bool
+
+	// Set once done is closed.
+	session *browserSession
+	err     error
+	took    time.Duration
+}
+
+// prelaunchBrowser starts launching the browser with the settings known so
+// far. It returns nil when the browser can't be launched ahead: a persistent
+// profile's lock is only taken once the session lock is held, so that two
+// runs can't each hold one lock and wait for the other. Cancelling ctx aborts
+// the launch.
+func prelaunchBrowser(ctx context.Context, config *Config) *browserPrelaunch {
+	if config.PersistSession || config.FreshSession {
+		log.Debug("Not pre-launching the browser: it runs on a persistent profile")
+		return nil
+	}
+
+	// The launch reads a copy, as the settings may still change meanwhile.
+	launchConfig := *config
+	p := &browserPrelaunch{key: launchKey(config), started: time.Now(), done: make(chan struct{})}
+	log.Debug("Pre-launching browser")
+	go func() {
+		defer close(p.done)
+		p.session, p.err = launchBrowser(ctx, &launchConfig)
+		p.took = time.Since(p.started)
+		log.Debug("Pre-launched browser ready", "took", p.took.Round(time.Millisecond), "error", p.err)
+	}()
+	return p
+}
+
+// launchKey sums up the settings a browser is launched with.
+func launchKey(config *Config) string {
+	return fmt.Sprintf("%t|%t|%t|%s|%q|%t|%s|%s|%s|%s|%s|%s",
+		config.ShowBrowser, config.PersistSession, config.FreshSession,
+		config.BrowserBin, config.BrowserFlags, config.Offline,
+		config.Proxy, config.ProxyPAC, config.ProxyUser, config.CAFile,
+		config.BrowserWS, config.BrowserURL)
+}
+
+// take returns the browser for the login: the pre-launched one if it started
+// and the settings haven't changed since (e.g. by an identity matched by the
+// URL), else a freshly launched one. p may be nil. If ctx is done while the
+// pre-launch is still starting, discard closes it.
+func (p *browserPrelaunch) take(ctx context.Context, config *Config) (*browserSession, error) {
+	if p == nil {
+		return launchBrowser(ctx, config)
+	}
+
+	waitStart := time.Now()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("stopped waiting for the browser: %v", context.Cause(ctx))
+	}
+	waited := time.Since(waitStart)
+	p.taken = true
+
+	switch {
+	case p.err != nil:
+		log.Debug("Pre-launching the browser failed; launching again", "error", p.err)
+	case p.key != launchKey(config):
+		log.Debug("Pre-launched browser doesn't match the selected settings; launching again")
+		p.session.close()
+	default:
+		log.Debug("Using pre-launched browser", "launch", p.took.Round(time.Millisecond),
+			"waited", waited.Round(time.Millisecond), "saved", (p.took - waited).Round(time.Millisecond))
+		return p.session, nil
+	}
+	return launchBrowser(ctx, config)
+}
+
+// discard closes the pre-launched browser unless the login took it, e.g.
+// when no URL arrived on stdin. p may be nil.
+func (p *browserPrelaunch) discard() {
+	if p == nil || p.taken {
+		return
+	}
+	<-p.done
+	if p.err == nil {
+		log.Debug("Closing unused pre-launched browser")
+		p.session.close()
+	}
+}
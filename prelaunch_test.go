@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestBrowserPrelaunch checks when the browser is launched ahead, and that a
+// pre-launch that failed or whose settings changed is replaced by a fresh
+// launch.
+func TestBrowserPrelaunch(t *testing.T) {
+	if p := prelaunchBrowser(t.Context(), &Config{PersistSession: true}); p != nil {
+		t.Error("pre-launched on a persistent profile")
+	}
+	var none *browserPrelaunch
+	none.discard()
+
+	config := &Config{BrowserBin: "/nonexistent/chromium"}
+	key := launchKey(config)
+	shown := *config
+	shown.ShowBrowser = true
+	if launchKey(&shown) == key {
+		t.Error("launchKey ignores --show-browser")
+	}
+
+	failed := &browserPrelaunch{key: key, done: make(chan struct{}), err: errors.New("launch failed")}
+	close(failed.done)
+	_, err := failed.take(t.Context(), config)
+	if err == nil || !strings.Contains(err.Error(), "not usable") {
+		t.Errorf("take after a failed pre-launch: err = %v, want a fresh launch's error", err)
+	}
+	if !failed.taken {
+		t.Error("take didn't mark the pre-launch taken")
+	}
+	failed.discard()
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+	"github.com/zalando/go-keyring"
+)
+
+// The key that encrypts stored cookies lives in the OS keyring (Secret
+// Service, macOS Keychain, Windows Credential Manager) under this service and
+// user. Without a keyring it falls back to ProfileKeyFile in the config dir,
+// away from the encrypted cookies in the cache dir.
+const (
+	ProfileKeyringService = "awsssologin"
+	ProfileKeyringUser    = "browser-profile-key"
+	ProfileKeyFile        = "profile.key"
+)
+
+// browserProfile is the persistent browser state kept for one identity: its
+// cookies, AES-GCM encrypted. Chromium itself runs on a throwaway
+// user-data-dir in the profile directory, removed once it exits, so its
+// plaintext cookie store never outlives the run.
+//
+// Runs of different sessions can share a profile (e.g. "default"), so a run
+// holds the profile's own lock, beside its directory, while it uses it. Each
+// user-data-dir also has a lock file, held while its browser runs, which
+// tells a live one from one left by a killed run.
+type browserProfile struct {
+	Name string
+	Dir  string
+
+	lock         *os.File // the profile's lock, taken by acquire
+	userData     string   // this run's user-data-dir, made by prepare
+	userDataLock *os.File
+}
+
+// profileNameRe matches the characters replaced in profile directory names.
+var profileNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// browserProfile returns the profile for this run's identity: the config file
+// identity, else the ~/.aws/config sso-session, else "default".
+func (c *Config) browserProfile() (*browserProfile, error) {
+	name := "default"
+	switch {
+	case c.identityName != "":
+		name = c.identityName
+	case c.awsSession != nil:
+		name = "sso-session-" + c.awsSession.Name
+	}
+	name = profileNameRe.ReplaceAllString(name, "_")
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("no user cache dir for the browser profile: %v", err)
+	}
+	return &browserProfile{Name: name, Dir: filepath.Join(cache, "awsssologin", "profiles", name)}, nil
+}
+
+// hasStoredSession reports whether this run will start from stored cookies,
+// in which case credential prompts wait until the sign-in form shows up.
+func (c *Config) hasStoredSession() bool {
+	if !c.PersistSession || c.FreshSession {
+		return false
+	}
+	profile, err := c.browserProfile()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(profile.cookiesPath())
+	return err == nil
+}
+
+func (p *browserProfile) cookiesPath() string { return filepath.Join(p.Dir, "cookies.enc") }
+func (p *browserProfile) lockPath() string    { return p.Dir + ".lock" }
+
+// acquire takes the profile's lock, waiting up to SessionLockWait for another
+// run using the profile. Waiting stops when ctx is done.
+func (p *browserProfile) acquire(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(p.Dir), 0o700); err != nil {
+		return fmt.Errorf("failed to create browser profile %s: %v", p.Dir, err)
+	}
+	f, err := os.OpenFile(p.lockPath(), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	waitStart := time.Now()
+	for waited := false; ; waited = true {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to lock %s: %v", f.Name(), err)
+		}
+		if ok {
+			break
+		}
+		if !waited {
+			log.Info("Another awsssologin is using this browser profile; waiting for it", "profile", p.Name)
+		}
+		if time.Since(waitStart) > SessionLockWait {
+			f.Close()
+			return fmt.Errorf("timed out after %s waiting for browser profile %s", SessionLockWait, p.Name)
+		}
+		if !sleepContext(ctx, SessionLockPoll) {
+			f.Close()
+			return fmt.Errorf("stopped waiting for browser profile %s: %v", p.Name, context.Cause(ctx))
+		}
+	}
+	p.lock = f
+	return nil
+}
+
+// release removes this run's user-data-dir, if it is still there, and
+// unlocks it and the profile. The browser must have exited.
+func (p *browserProfile) release() {
+	if p.userDataLock != nil {
+		if err := os.RemoveAll(p.userData); err != nil {
+			log.Warn("Failed to remove browser data", "dir", p.userData, "error", err)
+		}
+		_ = unlockFile(p.userDataLock)
+		p.userDataLock.Close()
+		os.Remove(p.userDataLock.Name())
+		p.userDataLock = nil
+	}
+	if p.lock != nil {
+		_ = unlockFile(p.lock)
+		p.lock.Close()
+		p.lock = nil
+	}
+}
+
+// reset discards the stored session and browser state.
+func (p *browserProfile) reset() error {
+	if err := os.RemoveAll(p.Dir); err != nil {
+		return fmt.Errorf("failed to remove browser profile %s: %v", p.Dir, err)
+	}
+	return nil
+}
+
+// prepare creates the profile directory, readable only by the user, and a
+// fresh user-data-dir in it, locked until release. User-data-dirs left behind
+// by a run that didn't get to remove its own (killed, crashed) are removed
+// first: they may hold the session in Chromium's plaintext cookie store.
+func (p *browserProfile) prepare() error {
+	if err := os.MkdirAll(p.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create browser profile %s: %v", p.Dir, err)
+	}
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "user-data") {
+			if err := removeLeftoverUserData(filepath.Join(p.Dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir, err := os.MkdirTemp(p.Dir, "user-data-")
+	if err != nil {
+		return fmt.Errorf("failed to create browser profile %s: %v", p.Dir, err)
+	}
+	lock, err := os.OpenFile(dir+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err == nil {
+		if err = lockFile(lock); err != nil {
+			lock.Close()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to lock browser data %s: %v", dir, err)
+	}
+	p.userData, p.userDataLock = dir, lock
+	return nil
+}
+
+// removeLeftoverUserData removes a user-data-dir and its lock file, unless
+// its lock is held: its browser is still running.
+func removeLeftoverUserData(dir string) error {
+	lock, err := os.OpenFile(dir+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if ok, err := tryLockFile(lock); err != nil || !ok {
+		log.Debug("Keeping browser data in use", "dir", dir, "error", err)
+		return nil
+	}
+	defer unlockFile(lock)
+
+	log.Debug("Removing leftover browser data", "dir", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove leftover browser data %s: %v", dir, err)
+	}
+	os.Remove(lock.Name())
+	return nil
+}
+
+// restoreCookies loads the stored cookies into the browser. No stored cookies
+// is not an error.
+func (p *browserProfile) restoreCookies(browser *rod.Browser) error {
+	sealed, err := os.ReadFile(p.cookiesPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	plain, err := p.open(sealed)
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+
+	var cookies []*proto.NetworkCookieParam
+	if err := json.Unmarshal(plain, &cookies); err != nil {
+		return fmt.Errorf("stored cookies are malformed: %v", err)
+	}
+	if err := browser.SetCookies(cookies); err != nil {
+		return fmt.Errorf("failed to set stored cookies: %v", err)
+	}
+	log.Info("Restored browser session", "profile", p.Name, "cookies", len(cookies))
+	return nil
+}
+
+// saveCookies encrypts the browser's cookies into the profile.
+func (p *browserProfile) saveCookies(browser *rod.Browser) error {
+	cookies, err := browser.GetCookies()
+	if err != nil {
+		return fmt.Errorf("failed to read cookies: %v", err)
+	}
+	plain, err := json.Marshal(proto.CookiesToParams(cookies))
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+
+	sealed, err := p.seal(plain)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(p.Dir, ".cookies-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p.cookiesPath()); err != nil {
+		return err
+	}
+	log.Debug("Saved browser session", "profile", p.Name, "cookies", len(cookies))
+	return nil
+}
+
+// seal encrypts plain with the profile key. The profile name is bound in as
+// additional data, so one identity's cookies can't be swapped into another's.
+func (p *browserProfile) seal(plain []byte) ([]byte, error) {
+	gcm, err := profileCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, []byte(p.Name)), nil
+}
+
+// open decrypts what seal produced.
+func (p *browserProfile) open(sealed []byte) ([]byte, error) {
+	gcm, err := profileCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("stored cookies are truncated")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, []byte(p.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stored cookies (key changed?): %v", err)
+	}
+	return plain, nil
+}
+
+// profileCipher returns AES-256-GCM keyed with the profile key.
+func profileCipher() (cipher.AEAD, error) {
+	encoded, err := profileKey()
+	if err != nil {
+		return nil, err
+	}
+	defer encoded.Wipe()
+
+	key, err := base64.StdEncoding.DecodeString(encoded.Reveal())
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("browser profile key is malformed")
+	}
+	defer clear(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// profileKey returns the profile key, creating it on first use. A key file
+// left from a run without a keyring keeps being used, so the stored cookies
+// stay readable; otherwise the key lives in the OS keyring if there is one.
+func profileKey() (Secret, error) {
+	path, err := profileKeyPath()
+	if err != nil {
+		return Secret{}, err
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		return secretFromBytes(data), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return Secret{}, fmt.Errorf("failed to read browser profile key: %v", err)
+	}
+
+	key, err := keyring.Get(ProfileKeyringService, ProfileKeyringUser)
+	if err == nil {
+		return NewSecret(key), nil
+	}
+	fresh, genErr := newProfileKey()
+	if genErr != nil {
+		return Secret{}, genErr
+	}
+	if errors.Is(err, keyring.ErrNotFound) {
+		if err = keyring.Set(ProfileKeyringService, ProfileKeyringUser, fresh.Reveal()); err == nil {
+			return fresh, nil
+		}
+	}
+
+	log.Warn("No OS keyring available; storing the browser profile key in a file", "path", path, "error", err)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		fresh.Wipe()
+		return Secret{}, err
+	}
+	if err := os.WriteFile(path, []byte(fresh.Reveal()), 0o600); err != nil {
+		fresh.Wipe()
+		return Secret{}, fmt.Errorf("failed to write browser profile key: %v", err)
+	}
+	return fresh, nil
+}
+
+// profileKeyPath is ProfileKeyFile in the awsssologin config dir.
+func profileKeyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no user config dir for the browser profile key: %v", err)
+	}
+	return filepath.Join(dir, "awsssologin", ProfileKeyFile), nil
+}
+
+// newProfileKey generates a random 256-bit key, base64-encoded.
+func newProfileKey() (Secret, error) {
+	key := make([]byte, 32)
+	defer clear(key)
+	if _, err := rand.Read(key); err != nil {
+		return Secret{}, err
+	}
+	return NewSecret(base64.StdEncoding.EncodeToString(key)), nil
+}
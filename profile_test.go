@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+// TestBrowserProfileSeal checks that stored cookies round-trip through the
+// profile key, are bound to their profile, and that a stored session is only
+// used when persistence is on and --fresh-session is off.
+func TestBrowserProfileSeal(t *testing.T) {
+	keyring.MockInit()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home+"/config")
+	t.Setenv("XDG_CACHE_HOME", home+"/cache")
+	t.Setenv("AppData", home+"/config")
+	t.Setenv("LocalAppData", home+"/cache")
+
+	config := &Config{identityName: "corp/admin", PersistSession: true}
+	profile, err := config.browserProfile()
+	if err != nil {
+		t.Fatalf("browserProfile: %v", err)
+	}
+	if profile.Name != "corp_admin" {
+		t.Errorf("profile name = %q, want %q", profile.Name, "corp_admin")
+	}
+
+	plain := []byte(`[{"name":"x-amz-sso_authn","value":"token"}]`)
+	sealed, err := profile.seal(plain)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("token")) {
+		t.Error("sealed cookies contain the plaintext")
+	}
+	opened, err := profile.open(sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Errorf("open = %q, %v", opened, err)
+	}
+	other := &browserProfile{Name: "lab", Dir: profile.Dir}
+	if _, err := other.open(sealed); err == nil {
+		t.Error("cookies sealed for one profile opened for another")
+	}
+
+	if config.hasStoredSession() {
+		t.Error("hasStoredSession before anything was stored")
+	}
+	// A run holds the profile's lock; another waits for it.
+	if err := profile.acquire(t.Context()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if err := (&browserProfile{Name: profile.Name, Dir: profile.Dir}).acquire(ctx); err == nil {
+		t.Error("a second run acquired a profile in use")
+	}
+
+	// A user-data-dir left by a killed run, and one of the layout that kept
+	// a single user-data-dir, are removed before the next launch; one whose
+	// browser still runs is kept.
+	for _, dir := range []string{"user-data", "user-data-123", "user-data-live"} {
+		leftover := filepath.Join(profile.Dir, dir, "Default")
+		if err := os.MkdirAll(leftover, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(leftover, "Cookies"), plain, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live, err := os.OpenFile(filepath.Join(profile.Dir, "user-data-live.lock"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	if err := lockFile(live); err != nil {
+		t.Fatal(err)
+	}
+	if err := profile.prepare(); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	for dir, want := range map[string]bool{
+		"user-data":                     false,
+		"user-data-123":                 false,
+		"user-data-live":                true,
+		filepath.Base(profile.userData): true,
+	} {
+		if _, err := os.Stat(filepath.Join(profile.Dir, dir)); (err == nil) != want {
+			t.Errorf("%s exists after prepare: %v, want %v", dir, err == nil, want)
+		}
+	}
+	userData := profile.userData
+	profile.release()
+	if _, err := os.Stat(userData); err == nil {
+		t.Error("release left the run's user-data-dir behind")
+	}
+	if err := profile.acquire(t.Context()); err != nil {
+		t.Errorf("acquire after release: %v", err)
+	}
+	profile.release()
+	if err := os.WriteFile(profile.cookiesPath(), sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !config.hasStoredSession() {
+		t.Error("hasStoredSession = false with stored cookies")
+	}
+	config.FreshSession = true
+	if config.hasStoredSession() {
+		t.Error("hasStoredSession = true with --fresh-session")
+	}
+}
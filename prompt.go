@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/term"
+)
+
+// Prompt backends selectable with --prompt-backend.
+const (
+	// PromptBackendTTY prompts on the controlling terminal (the default).
+	PromptBackendTTY = "tty"
+	// PromptBackendPinentry collects secrets through a pinentry program.
+	// pinentry masks whatever is typed, so plain values such as the username
+	// are still read on the controlling terminal.
+	PromptBackendPinentry = "pinentry"
+	// PromptBackendStdin prompts on stdin/stdout; unusable when the URL is
+	// piped in on stdin.
+	PromptBackendStdin = "stdin"
+)
+
+// checkPromptBackend reports why the configured prompt backend can't be used,
+// or nil if it can.
+func checkPromptBackend(config *Config) error {
+	switch config.PromptBackend {
+	case PromptBackendPinentry:
+		if _, err := exec.LookPath(config.PinentryProgram); err != nil {
+			return fmt.Errorf("pinentry program not found: %v", err)
+		}
+		if config.Username == "" && !ttyAvailable() {
+			return fmt.Errorf("no controlling terminal for the username prompt, which pinentry doesn't ask")
+		}
+	case PromptBackendStdin:
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("stdin is not a terminal")
+		}
+	default:
+		if !ttyAvailable() {
+			return fmt.Errorf("no controlling terminal")
+		}
+	}
+	return nil
+}
+
+// ttyAvailable reports whether a controlling terminal can be opened for
+// interactive prompts.
+func ttyAvailable() bool {
+	_, _, closeTTY, err := openTTY()
+	if err != nil {
+		log.Debug("No terminal available for prompts", "error", err)
+		return false
+	}
+	closeTTY()
+	return true
+}
+
+// promptForInput asks for a plain value through the configured prompt
+// backend, or the terminal in place of pinentry, which would hide what is
+// typed. secure input is read without echo.
+func promptForInput(ctx context.Context, config *Config, prompt string, secure bool) (string, error) {
+	backend := config.PromptBackend
+	if backend == PromptBackendPinentry {
+		backend = PromptBackendTTY
+	}
+	input, err := readPrompt(ctx, config, backend, prompt, secure)
+	if err != nil {
+		return "", err
+	}
+	return string(input), nil
+}
+
+// promptForSecret asks for a secret through the configured prompt backend;
+// pinentry never echoes. The input goes straight into a Secret and the
+// intermediate buffer is cleared.
+func promptForSecret(ctx context.Context, config *Config, prompt string, secure bool) (Secret, error) {
+	input, err := readPrompt(ctx, config, config.PromptBackend, prompt, secure)
+	if err != nil {
+		return Secret{}, err
+	}
+	return secretFromBytes(input), nil
+}
+
+// readPrompt reads one non-empty answer through the given prompt backend. It
+// gives up when ctx is done.
+func readPrompt(ctx context.Context, config *Config, backend, prompt string, secure bool) ([]byte, error) {
+	var (
+		input []byte
+		err   error
+	)
+
+	switch backend {
+	case PromptBackendPinentry:
+		var pin string
+		pin, err = pinentryGetPin(ctx, config.PinentryProgram, strings.TrimSuffix(strings.TrimSpace(prompt), ":"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input from pinentry: %v", err)
+		}
+		input = []byte(pin)
+	case PromptBackendStdin:
+		input, err = readInput(ctx, os.Stdin, os.Stdout, prompt, secure)
+	default:
+		in, out, closeTTY, ttyErr := openTTY()
+		if ttyErr != nil {
+			return nil, fmt.Errorf("no terminal for interactive prompt: %v", ttyErr)
+		}
+		defer closeTTY()
+		input, err = readInput(ctx, in, out, prompt, secure)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// if input is empty, return error
+	if len(input) == 0 {
+		return nil, fmt.Errorf("input is empty")
+	}
+
+	return input, nil
+}
+
+// readInput writes prompt to out and reads one line from in, without echo
+// when secure is set. A read can't be interrupted: when ctx is done first it
+// is abandoned, and the terminal's echo restored.
+func readInput(ctx context.Context, in *os.File, out io.Writer, prompt string, secure bool) ([]byte, error) {
+	fmt.Fprint(out, prompt)
+
+	type answer struct {
+		input []byte
+		err   error
+	}
+	answers := make(chan answer, 1)
+	state, _ := term.GetState(int(in.Fd()))
+
+	go func() {
+		if secure { // password input
+			password, err := term.ReadPassword(int(in.Fd()))
+			fmt.Fprintln(out) // Add newline after password input
+			if err != nil {
+				err = fmt.Errorf("failed to read secure input: %v", err)
+			}
+			answers <- answer{password, err}
+			return
+		}
+
+		// plain text input
+		reader := bufio.NewReader(in)
+		input, err := reader.ReadBytes('\n')
+		if err != nil {
+			answers <- answer{nil, fmt.Errorf("failed to read plain text input: %v", err)}
+			return
+		}
+		answers <- answer{bytes.TrimSpace(input), nil}
+	}()
+
+	select {
+	case a := <-answers:
+		return a.input, a.err
+	case <-ctx.Done():
+		if state != nil {
+			_ = term.Restore(int(in.Fd()), state)
+		}
+		fmt.Fprintln(out)
+		return nil, fmt.Errorf("prompt abandoned: %v", context.Cause(ctx))
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ProxyDirect as --proxy ignores HTTPS_PROXY and HTTP_PROXY.
+	ProxyDirect = "direct"
+	// EnvProxyPassword supplies the proxy password when the proxy URL has
+	// none, e.g. with --proxy-user or a PAC file.
+	EnvProxyPassword = "AWSSSOLOGIN_PROXY_PASSWORD"
+)
+
+// proxyEnvVars are the standard proxy variables, in the order they are
+// consulted. The login pages are all https, so HTTPS_PROXY comes first.
+var proxyEnvVars = []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"}
+
+// proxySettings is how the launched browser reaches the network.
+type proxySettings struct {
+	Server   string // --proxy-server value, without credentials; "" for none
+	PAC      string // --proxy-pac-url value
+	Bypass   string // --proxy-bypass-list value, from NO_PROXY
+	Source   string // the flag, setting or env var it came from
+	Username string
+	Password Secret
+}
+
+// resolveProxy works out the browser's proxy: --proxy-pac or --proxy (flag or
+// settings files), else HTTPS_PROXY/HTTP_PROXY, with NO_PROXY as the bypass
+// list. The caller should wipe the result.
+func (c *Config) resolveProxy() (*proxySettings, error) {
+	p := &proxySettings{Username: c.ProxyUser}
+
+	raw, source := c.Proxy, c.settingSource("proxy")
+	switch {
+	case c.ProxyPAC != "":
+		u, err := url.Parse(c.ProxyPAC)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" && u.Scheme != "data") {
+			return nil, fmt.Errorf("--proxy-pac must be an http, https, file or data URL")
+		}
+		p.PAC, p.Source = c.ProxyPAC, c.settingSource("proxy-pac")
+		raw = ""
+	case raw == ProxyDirect:
+		p.Source = source
+		return p, nil
+	case raw == "":
+		for _, env := range proxyEnvVars {
+			if v := os.Getenv(env); v != "" {
+				raw, source = v, env
+				break
+			}
+		}
+	}
+
+	if raw != "" {
+		// Like curl, a bare host:port means an http proxy.
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL from %s", source)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks4", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q from %s; use http, https, socks4 or socks5", u.Scheme, source)
+		}
+		p.Server, p.Source = u.Scheme+"://"+u.Host, source
+		if u.User != nil {
+			if p.Username == "" {
+				p.Username = u.User.Username()
+			}
+			if pw, ok := u.User.Password(); ok {
+				p.Password = NewSecret(pw)
+			}
+		}
+		if p.Username != "" && strings.HasPrefix(u.Scheme, "socks") {
+			return nil, fmt.Errorf("the browser can't authenticate to a %s proxy", u.Scheme)
+		}
+	}
+
+	if p.Server == "" && p.PAC == "" {
+		return p, nil
+	}
+	if p.Username != "" && !p.Password.IsSet() {
+		env := os.Getenv(EnvProxyPassword)
+		if env == "" {
+			return nil, fmt.Errorf("no password for proxy user %s: put it in the proxy URL or %s", p.Username, EnvProxyPassword)
+		}
+		p.Password = NewSecret(env)
+	}
+	p.Bypass = chromeBypassList(noProxy())
+	return p, nil
+}
+
+// describe summarizes the settings for logs and `doctor`, without secrets.
+func (p *proxySettings) describe() string {
+	var parts []string
+	switch {
+	case p.PAC != "":
+		parts = append(parts, "PAC "+p.PAC)
+	case p.Server != "":
+		parts = append(parts, p.Server)
+	default:
+		return "direct"
+	}
+	parts = append(parts, "from "+p.Source)
+	if p.Username != "" {
+		parts = append(parts, "as "+p.Username)
+	}
+	if p.Bypass != "" {
+		parts = append(parts, "bypassing "+p.Bypass)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// wipe clears the proxy password.
+func (p *proxySettings) wipe() {
+	p.Password.Wipe()
+}
+
+// settingSource names where a setting without an env var came from: its flag,
+// else the settings files.
+func (c *Config) settingSource(flag string) string {
+	if c.flagChanged(flag) {
+		return "--" + flag
+	}
+	return "config file"
+}
+
+// noProxy returns NO_PROXY, or no_proxy.
+func noProxy() string {
+	if v := os.Getenv("NO_PROXY"); v != "" {
+		return v
+	}
+	return os.Getenv("no_proxy")
+}
+
+// chromeBypassList converts a NO_PROXY value to Chromium's bypass list.
+// NO_PROXY entries match a host and its subdomains; Chromium needs a
+// separate wildcard rule for the subdomains. Loopback is always bypassed by
+// Chromium, so the CLI's local callback is never proxied.
+func chromeBypassList(noProxy string) string {
+	var rules []string
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case entry == "*":
+			rules = append(rules, "*")
+		case strings.HasPrefix(entry, "."):
+			rules = append(rules, "*"+entry)
+		case strings.HasPrefix(entry, "*."), strings.Contains(entry, "/"), strings.Trim(entry, "0123456789.:[]") == "":
+			rules = append(rules, entry) // already a wildcard, a CIDR range or an IP
+		default:
+			rules = append(rules, entry, "*."+entry)
+		}
+	}
+	return strings.Join(rules, ";")
+}
+
+// caSPKIHashes reads the PEM certificates of a --ca-file and returns the
+// base64 SHA-256 hashes of their public keys, the form Chromium's
+// --ignore-certificate-errors-spki-list takes. Certificate errors are then
+// ignored only for chains that contain one of these certificates.
+func caSPKIHashes(path string) ([]string, error) {
+	certs, err := readCAFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		hashes = append(hashes, base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return hashes, nil
+}
+
+// readCAFile parses every certificate in a PEM file.
+func readCAFile(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in CA file %s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("CA file %s has no PEM certificates", path)
+	}
+	return certs, nil
+}
+
+// httpClient returns a client for requests awsssologin makes itself (the
+// Chromium download, `doctor` probes) that goes through the same proxy and
+// trusts the same CA as the browser. A PAC file can't be evaluated here, so
+// with one the environment's proxy is used.
+func (c *Config) httpClient(timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	p, err := c.resolveProxy()
+	if err != nil {
+		return nil, err
+	}
+	defer p.wipe()
+	if p.Server != "" {
+		proxyURL, _ := url.Parse(p.Server)
+		if p.Username != "" {
+			proxyURL.User = url.UserPassword(p.Username, p.Password.Reveal())
+		}
+		bypass := p.Bypass
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassesProxy(bypass, req.URL.Hostname()) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	} else if c.Proxy == ProxyDirect {
+		transport.Proxy = nil
+	}
+
+	if c.CAFile != "" {
+		certs, err := readCAFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// bypassesProxy reports whether host matches a Chromium bypass list made by
+// chromeBypassList. Only the host rules are honoured.
+func bypassesProxy(bypass, host string) bool {
+	for _, rule := range strings.Split(bypass, ";") {
+		switch {
+		case rule == "":
+		case rule == "*":
+			return true
+		case strings.HasPrefix(rule, "*."):
+			if strings.HasSuffix(host, rule[1:]) {
+				return true
+			}
+		case strings.EqualFold(rule, host):
+			return true
+		}
+	}
+	return false
+}
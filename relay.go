@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// RelayMaxBody bounds the callback listener's response handed back to the
+// browser: a "you may close this window" page.
+const RelayMaxBody = 1 << 20
+
+// callbackRelay replays the OAuth callback request, intercepted in the login
+// tab, from this process to the CLI's local listener, and hands the
+// listener's response back to the browser. The browser then never has to
+// reach the listener itself, which a browser in a container or on another
+// host can't.
+type callbackRelay struct {
+	prefix string // origin of the redirect_uri, e.g. http://localhost:8085
+	client *http.Client
+}
+
+// newCallbackRelay relays requests to the origin prefix. The listener is
+// local, so no proxy is used, and its redirects are handed back rather than
+// followed.
+func newCallbackRelay(prefix string, timeout time.Duration) *callbackRelay {
+	return &callbackRelay{
+		prefix: prefix,
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: nil},
+			Timeout:   timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// matches reports whether a request goes to the callback listener.
+func (r *callbackRelay) matches(rawURL string) bool {
+	return rawURL == r.prefix || strings.HasPrefix(rawURL, r.prefix+"/")
+}
+
+// forward sends the paused request to the listener and returns the response
+// that fulfils it in the browser.
+func (r *callbackRelay) forward(e *proto.FetchRequestPaused) (*proto.FetchFulfillRequest, error) {
+	var body io.Reader
+	if e.Request.PostData != "" {
+		body = strings.NewReader(e.Request.PostData)
+	}
+	req, err := http.NewRequest(e.Request.Method, e.Request.URL, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build callback request: %v", err)
+	}
+	for name, value := range e.Request.Headers {
+		req.Header.Set(name, value.Str())
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the callback listener at %s: %v", r.prefix, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, RelayMaxBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the callback listener's response: %v", err)
+	}
+
+	fulfill := &proto.FetchFulfillRequest{
+		RequestID:    e.RequestID,
+		ResponseCode: resp.StatusCode,
+		Body:         respBody,
+	}
+	for name, values := range resp.Header {
+		if name == "Content-Length" {
+			continue // the body may have been cut
+		}
+		for _, value := range values {
+			fulfill.ResponseHeaders = append(fulfill.ResponseHeaders, &proto.FetchHeaderEntry{Name: name, Value: value})
+		}
+	}
+	log.Info("Relayed login callback to the local listener", "listener", r.prefix, "status", resp.StatusCode)
+	return fulfill, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// TestCallbackRelay replays intercepted callback requests to an httptest
+// listener and checks what is handed back to the browser: the listener's
+// response, its redirects unfollowed, and a failed relay failing the waits.
+func TestCallbackRelay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth/callback":
+			if r.URL.Query().Get("code") != "abc" || r.UserAgent() != "HeadlessChrome" {
+				http.Error(w, "bad callback", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "Authentication successful. You may close this window.")
+		case "/form_post":
+			body, _ := io.ReadAll(r.Body)
+			io.WriteString(w, r.Method+" "+string(body))
+		default:
+			http.Redirect(w, r, "/auth/callback", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	relay := newCallbackRelay(srv.URL, 5*time.Second)
+	if !relay.matches(srv.URL+"/auth/callback?code=abc") || relay.matches(srv.URL+"0/auth/callback") || relay.matches("https://dex.example.com/?r="+srv.URL) {
+		t.Error("matches doesn't tell the listener's URLs from others")
+	}
+
+	var headers proto.NetworkHeaders
+	if err := json.Unmarshal([]byte(`{"User-Agent": "HeadlessChrome"}`), &headers); err != nil {
+		t.Fatal(err)
+	}
+	paused := func(method, path, postData string) *proto.FetchRequestPaused {
+		return &proto.FetchRequestPaused{RequestID: "1", Request: &proto.NetworkRequest{
+			URL: srv.URL + path, Method: method, Headers: headers, PostData: postData,
+		}}
+	}
+
+	fulfill, err := relay.forward(paused("GET", "/auth/callback?code=abc&state=xyz", ""))
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if fulfill.RequestID != "1" || fulfill.ResponseCode != http.StatusOK || !strings.Contains(string(fulfill.Body), "successful") {
+		t.Errorf("relayed callback = %d %q", fulfill.ResponseCode, fulfill.Body)
+	}
+	if !hasHeader(fulfill, "Content-Type", "text/html") {
+		t.Errorf("relayed headers = %v, want the listener's Content-Type", fulfill.ResponseHeaders)
+	}
+
+	if fulfill, err := relay.forward(paused("GET", "/", "")); err != nil || fulfill.ResponseCode != http.StatusFound || !hasHeader(fulfill, "Location", "/auth/callback") {
+		t.Errorf("redirect = %+v, %v; want it handed back unfollowed", fulfill, err)
+	}
+	if fulfill, err := relay.forward(paused("POST", "/form_post", "code=abc")); err != nil || string(fulfill.Body) != "POST code=abc" {
+		t.Errorf("form_post callback = %+v, %v", fulfill, err)
+	}
+
+	srv.Close()
+	_, err = relay.forward(paused("GET", "/auth/callback?code=abc", ""))
+	if err == nil || !strings.Contains(err.Error(), "failed to reach the callback listener") {
+		t.Fatalf("forward to a closed listener = %v", err)
+	}
+	w := newPageWatch(t.Context())
+	w.fail(err)
+	callback, cbErr := oidcCallbackFor("https://dex.example.com/auth?redirect_uri=" + url.QueryEscape(srv.URL+"/auth/callback"))
+	if cbErr != nil {
+		t.Fatalf("oidcCallbackFor: %v", cbErr)
+	}
+	if _, got := w.wait(time.Minute, "redirect to "+callback.String(), w.atCallback(callback)); !errors.Is(got, err) {
+		t.Errorf("wait after a failed relay = %v, want %v", got, err)
+	}
+}
+
+func hasHeader(f *proto.FetchFulfillRequest, name, value string) bool {
+	for _, h := range f.ResponseHeaders {
+		if h.Name == name && h.Value == value {
+			return true
+		}
+	}
+	return false
+}
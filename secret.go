@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// redacted is what a Secret prints as, whatever the format verb.
+const redacted = "[REDACTED]"
+
+// Secret holds sensitive material (password, 2FA code, TOTP secret) in a
+// buffer that is locked into RAM where the OS allows it, so it is never
+// swapped to disk, and that is zeroed by Wipe. Formatting a Secret with any
+// fmt verb, or marshalling it to JSON, yields "[REDACTED]", so it can't leak
+// into logs, errors or debug dumps by accident.
+//
+// Copies of a Secret share the same buffer: wiping one wipes them all. The
+// zero value is an empty, unset secret.
+//
+// Reveal necessarily copies the value into an ordinary Go string (rod and the
+// TOTP library take strings); callers should keep that copy short-lived.
+type Secret struct {
+	buf *secretBuffer
+}
+
+type secretBuffer struct {
+	data []byte // locked memory; nil once wiped
+	n    int    // length of the secret within data
+}
+
+// NewSecret copies s into a new locked buffer.
+func NewSecret(s string) Secret {
+	return secretFromBytes([]byte(s))
+}
+
+// secretFromBytes copies b into a new locked buffer and zeroes b.
+func secretFromBytes(b []byte) Secret {
+	if len(b) == 0 {
+		return Secret{}
+	}
+	data := allocLocked(len(b))
+	n := copy(data, b)
+	clear(b)
+	return Secret{buf: &secretBuffer{data: data, n: n}}
+}
+
+// IsSet reports whether the secret holds a non-empty, unwiped value.
+func (s Secret) IsSet() bool {
+	return s.buf != nil && s.buf.data != nil && s.buf.n > 0
+}
+
+// Reveal returns the secret as a string, or "" if it is unset or wiped.
+func (s Secret) Reveal() string {
+	if !s.IsSet() {
+		return ""
+	}
+	return string(s.buf.data[:s.buf.n])
+}
+
+// Wipe zeroes and releases the buffer. It is safe to call more than once.
+func (s Secret) Wipe() {
+	if s.buf == nil || s.buf.data == nil {
+		return
+	}
+	clear(s.buf.data)
+	freeLocked(s.buf.data)
+	s.buf.data, s.buf.n = nil, 0
+}
+
+// String redacts the value. An unset secret prints as "" so pflag treats it
+// as having no default.
+func (s Secret) String() string {
+	if !s.IsSet() {
+		return ""
+	}
+	return redacted
+}
+
+// GoString redacts the value for %#v.
+func (s Secret) GoString() string {
+	return redacted
+}
+
+// Format redacts the value for every fmt verb, including %x and %q, which
+// would otherwise bypass String.
+func (s Secret) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, s.String())
+}
+
+// MarshalJSON redacts the value.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON reads a JSON string into a new locked buffer.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = NewSecret(v)
+	return nil
+}
+
+// Set implements pflag.Value so secrets can be bound to flags directly.
+func (s *Secret) Set(v string) error {
+	s.Wipe()
+	*s = NewSecret(v)
+	return nil
+}
+
+// Type implements pflag.Value.
+func (s *Secret) Type() string {
+	return "string"
+}
+
+// wipeSecrets zeroes every secret held by the config once it is no longer
+// needed.
+func (c *Config) wipeSecrets() {
+	c.Password.Wipe()
+	c.TwoFA.Wipe()
+	c.TOTPSecret.Wipe()
+	c.OOBCode.Wipe()
+}
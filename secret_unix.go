@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/charmbracelet/log"
+	"golang.org/x/sys/unix"
+)
+
+// allocLocked returns n bytes of anonymous memory outside the Go heap (so the
+// GC never copies it) and tries to mlock it. Locking is best-effort: a low
+// RLIMIT_MEMLOCK only means the secret could be swapped.
+func allocLocked(n int) []byte {
+	data, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		log.Debug("Could not map memory for secret, using the Go heap", "error", err)
+		return make([]byte, n)
+	}
+	if err := unix.Mlock(data); err != nil {
+		log.Debug("Could not lock secret memory", "error", err)
+	}
+	return data
+}
+
+// freeLocked unlocks and unmaps memory from allocLocked.
+func freeLocked(data []byte) {
+	_ = unix.Munlock(data)
+	// Heap fallbacks aren't mappings; Munmap just fails for them.
+	_ = unix.Munmap(data)
+}
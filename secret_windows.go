@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"unsafe"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/sys/windows"
+)
+
+// allocLocked returns n bytes and tries to lock them into the working set.
+// The Go GC doesn't move heap objects, so locking a heap slice is sound.
+// Locking is best-effort: failure only means the secret could be paged out.
+func allocLocked(n int) []byte {
+	data := make([]byte, n)
+	if err := windows.VirtualLock(uintptr(unsafe.Pointer(&data[0])), uintptr(n)); err != nil {
+		log.Debug("Could not lock secret memory", "error", err)
+	}
+	return data
+}
+
+// freeLocked unlocks memory from allocLocked.
+func freeLocked(data []byte) {
+	_ = windows.VirtualUnlock(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
+}
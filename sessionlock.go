@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// SessionLockWait bounds waiting for a concurrent login of the same
+	// session; it matches the lifetime of an AWS device code.
+	SessionLockWait = 10 * time.Minute
+	// SessionLockPoll is how often a waiting invocation retries the lock.
+	SessionLockPoll = 500 * time.Millisecond
+	// TokenExpiryMargin is how long a cached SSO token must still be valid
+	// for a waiting login to be skipped.
+	TokenExpiryMargin = 5 * time.Minute
+)
+
+// sessionLock serializes logins of one session across invocations. Beside
+// the lock file, the holder keeps a result file recording how its login went
+// for the invocations waiting behind it.
+type sessionLock struct {
+	file       *os.File
+	resultPath string
+	result     sessionResult
+}
+
+// sessionResult is the result file of a session lock.
+type sessionResult struct {
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"`
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+	// Rejected records that the login failed because the credentials or
+	// MFA code were rejected, rather than e.g. a timeout.
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// sessionLockKey names what is locked: the config file identity, else the
+// AWS start URL of a device URL or the origin of a Dex URL.
+func (c *Config) sessionLockKey(loginURL string) string {
+	if c.identityName != "" {
+		return "identity:" + c.identityName
+	}
+	if start := deviceStartURL(loginURL); start != "" && c.DexURL == "" {
+		return "start-url:" + start
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "url:" + loginURL
+	}
+	return "origin:" + u.Scheme + "://" + u.Host
+}
+
+// acquireSessionLock takes the lock for this login's session, waiting up to
+// SessionLockWait if another invocation holds it. If it had to wait and that
+// invocation left a result, the result is returned too. Waiting stops when
+// ctx is done.
+func acquireSessionLock(ctx context.Context, config *Config, loginURL string) (*sessionLock, *sessionResult, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, nil, fmt.Errorf("no user cache dir for the session lock: %v", err)
+	}
+	key := config.sessionLockKey(loginURL)
+	sum := sha256.Sum256([]byte(key))
+	base := filepath.Join(cache, "awsssologin", "locks", fmt.Sprintf("%x", sum[:8]))
+	if err := os.MkdirAll(filepath.Dir(base), 0o700); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(base+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	lock := &sessionLock{file: f, resultPath: base + ".json"}
+
+	waitStart := time.Now()
+	waited := false
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to lock %s: %v", f.Name(), err)
+		}
+		if ok {
+			break
+		}
+		if !waited {
+			waited = true
+			holder := lock.readResult()
+			log.Info("Another awsssologin is logging in to this session; waiting for it", "session", key, "pid", holder.PID)
+		}
+		if time.Since(waitStart) > SessionLockWait {
+			f.Close()
+			return nil, nil, fmt.Errorf("timed out after %s waiting for a concurrent login of %s", SessionLockWait, key)
+		}
+		if !sleepContext(ctx, SessionLockPoll) {
+			f.Close()
+			return nil, nil, fmt.Errorf("stopped waiting for a concurrent login of %s: %v", key, context.Cause(ctx))
+		}
+	}
+
+	var previous *sessionResult
+	if waited {
+		// A result finished while we waited is the concurrent login's. A
+		// holder that died without finishing leaves none.
+		if r := lock.readResult(); r.Finished.After(waitStart) {
+			previous = &r
+		}
+	}
+
+	lock.result = sessionResult{PID: os.Getpid(), Started: time.Now()}
+	lock.writeResult()
+	return lock, previous, nil
+}
+
+// release records the login's outcome for waiting invocations and unlocks.
+// rejected tells a failure caused by rejected credentials or MFA code.
+func (l *sessionLock) release(loginErr error, rejected bool) {
+	l.result.Finished = time.Now()
+	l.result.OK = loginErr == nil
+	if loginErr != nil {
+		l.result.Error = loginErr.Error()
+		l.result.Rejected = rejected
+	}
+	l.writeResult()
+	if err := unlockFile(l.file); err != nil {
+		log.Debug("Failed to unlock session lock", "error", err)
+	}
+	l.file.Close()
+}
+
+// readResult returns the result file's contents, or the zero value.
+func (l *sessionLock) readResult() sessionResult {
+	var r sessionResult
+	if data, err := os.ReadFile(l.resultPath); err == nil {
+		_ = json.Unmarshal(data, &r)
+	}
+	return r
+}
+
+// writeResult replaces the result file. Failing to write it only costs
+// waiting invocations the shortcut.
+func (l *sessionLock) writeResult() {
+	data, _ := json.Marshal(l.result)
+	if err := os.WriteFile(l.resultPath, data, 0o600); err != nil {
+		log.Debug("Failed to write session lock result", "error", err)
+	}
+}
+
+// afterConcurrentLogin decides what a login that waited for a concurrent one
+// of the same session does next. It reports done when the login should not
+// launch a browser: the concurrent login's credentials or MFA code were
+// rejected (retrying them risks locking the account), or it left a valid SSO
+// token for this device URL's start URL. Any other failure, such as a timeout
+// or an interruption, says nothing about the credentials.
+func afterConcurrentLogin(previous *sessionResult, config *Config, loginURL string) (done bool, err error) {
+	if !previous.OK && previous.Rejected {
+		return true, fmt.Errorf("a concurrent login of this session (pid %d) had its credentials rejected, not retrying: %s", previous.PID, previous.Error)
+	}
+	if !previous.OK {
+		log.Info("Concurrent login of this session failed; logging in", "pid", previous.PID, "error", previous.Error)
+		return false, nil
+	}
+	if config.DexURL != "" {
+		log.Info("Concurrent login of this session succeeded; continuing with this Dex login", "pid", previous.PID)
+		return false, nil
+	}
+
+	start := deviceStartURL(loginURL)
+	if expires, ok := cachedSSOTokenExpiry(start); ok {
+		log.Info("Concurrent login of this session left a valid SSO token; skipping this login",
+			"pid", previous.PID, "startURL", start, "expires", expires.Local().Format(time.DateTime))
+		return true, nil
+	}
+	log.Info("Concurrent login of this session succeeded but left no valid SSO token; logging in", "pid", previous.PID)
+	return false, nil
+}
+
+// deviceStartURL returns the AWS access portal start URL of a device URL,
+// e.g. "https://corp.awsapps.com/start", or "" for anything else.
+func deviceStartURL(loginURL string) string {
+	if validateDeviceURL(loginURL) != nil {
+		return ""
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/start"
+}
+
+// cachedSSOTokenExpiry looks through the AWS CLI's SSO token cache
+// (~/.aws/sso/cache) for a token for startURL valid for at least
+// TokenExpiryMargin, and returns its expiry.
+func cachedSSOTokenExpiry(startURL string) (time.Time, bool) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return time.Time{}, false
+	}
+	files, _ := filepath.Glob(filepath.Join(home, ".aws", "sso", "cache", "*.json"))
+
+	want := strings.TrimRight(startURL, "/#")
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var token struct {
+			StartURL    string `json:"startUrl"`
+			AccessToken string `json:"accessToken"`
+			ExpiresAt   string `json:"expiresAt"`
+		}
+		if json.Unmarshal(data, &token) != nil || token.AccessToken == "" {
+			continue
+		}
+		if strings.TrimRight(token.StartURL, "/#") != want {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, token.ExpiresAt)
+		if err != nil {
+			// AWS CLI v1 wrote e.g. "2024-05-01T12:00:00UTC".
+			if expires, err = time.Parse("2006-01-02T15:04:05MST", token.ExpiresAt); err != nil {
+				continue
+			}
+		}
+		if time.Until(expires) > TokenExpiryMargin {
+			return expires, true
+		}
+	}
+	return time.Time{}, false
+}
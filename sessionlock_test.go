@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSessionLock checks that a second login of a session waits for the
+// first, gets its result, and is skipped once the AWS CLI has a valid token.
+func TestSessionLock(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, "cache"))
+	t.Setenv("LocalAppData", filepath.Join(home, "cache"))
+	t.Setenv("USERPROFILE", home)
+
+	config := &Config{DeviceURL: testDeviceURL}
+	first, previous, err := acquireSessionLock(t.Context(), config, testDeviceURL)
+	if err != nil || previous != nil {
+		t.Fatalf("first acquireSessionLock = %v, %v", previous, err)
+	}
+
+	type acquired struct {
+		lock     *sessionLock
+		previous *sessionResult
+		err      error
+	}
+	second := make(chan acquired)
+	go func() {
+		lock, previous, err := acquireSessionLock(t.Context(), config, testDeviceURL)
+		second <- acquired{lock, previous, err}
+	}()
+
+	select {
+	case <-second:
+		t.Fatal("second login didn't wait for the first")
+	case <-time.After(200 * time.Millisecond):
+	}
+	// The first login's password is rejected; the waiting one refuses to
+	// replay it.
+	firstConfig := &Config{DeviceURL: testDeviceURL}
+	loginErr := credentialsRejected(firstConfig, "AWS rejected the credentials: %s", "Incorrect username or password")
+	first.release(loginErr, firstConfig.rejected)
+
+	got := <-second
+	if got.err != nil || got.previous == nil || got.previous.OK || got.previous.Error != loginErr.Error() || !got.previous.Rejected {
+		t.Fatalf("second acquireSessionLock = %+v", got)
+	}
+	if done, err := afterConcurrentLogin(got.previous, config, testDeviceURL); !done || err == nil || !strings.Contains(err.Error(), "Incorrect username or password") {
+		t.Errorf("after a rejected password: done=%v err=%v, want a refusal", done, err)
+	}
+	timedOut := &sessionResult{PID: 1, Error: "timed out waiting for the password field"}
+	if done, err := afterConcurrentLogin(timedOut, config, testDeviceURL); done || err != nil {
+		t.Errorf("after a timeout: done=%v err=%v, want a login", done, err)
+	}
+
+	succeeded := &sessionResult{PID: 1, OK: true}
+	if done, err := afterConcurrentLogin(succeeded, config, testDeviceURL); done || err != nil {
+		t.Errorf("without a cached token: done=%v err=%v, want a login", done, err)
+	}
+
+	cache := filepath.Join(home, ".aws", "sso", "cache")
+	if err := os.MkdirAll(cache, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	token := `{"startUrl": "https://corp.awsapps.com/start/#", "accessToken": "x", "expiresAt": "` +
+		time.Now().Add(8*time.Hour).UTC().Format(time.RFC3339) + `"}`
+	if err := os.WriteFile(filepath.Join(cache, "token.json"), []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := afterConcurrentLogin(succeeded, config, testDeviceURL); !done || err != nil {
+		t.Errorf("with a cached token: done=%v err=%v, want a skip", done, err)
+	}
+
+	// A batch waits for the lock too, and skips the item the token covers.
+	item := &batchItem{Source: "--url", URL: testDeviceURL, Flow: "device"}
+	locked := make(chan error)
+	go func() {
+		locks, err := lockBatchSessions(t.Context(), &Config{}, []*batchItem{item})
+		for _, l := range locks {
+			l.release(nil)
+		}
+		locked <- err
+	}()
+	select {
+	case <-locked:
+		t.Fatal("batch didn't wait for the concurrent login")
+	case <-time.After(200 * time.Millisecond):
+	}
+	got.lock.release(nil, false)
+	if err := <-locked; err != nil || item.Err != nil || !item.skipped {
+		t.Errorf("lockBatchSessions = %v; item err=%v skipped=%v, want a skip", err, item.Err, item.skipped)
+	}
+}
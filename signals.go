@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// interruptedError is the cause of a run cancelled by SIGINT or SIGTERM.
+type interruptedError struct {
+	signal os.Signal
+}
+
+func (e interruptedError) Error() string {
+	switch e.signal {
+	case os.Interrupt:
+		return "interrupted by SIGINT"
+	case syscall.SIGTERM:
+		return "interrupted by SIGTERM"
+	}
+	return fmt.Sprintf("interrupted by %s", e.signal)
+}
+
+// exitCode is the shell's code for a process killed by the signal: 130 for
+// SIGINT, 143 for SIGTERM.
+func (e interruptedError) exitCode() int {
+	if sig, ok := e.signal.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 130
+}
+
+// interruptContext returns a context cancelled by the first SIGINT or
+// SIGTERM, so the run can dump the page, close the browser and exit. A
+// second signal exits at once.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		interrupted := interruptedError{sig}
+		log.Warn("Interrupted; closing the browser (signal again to exit at once)", "signal", sig)
+		cancel(interrupted)
+
+		if _, ok := <-signals; ok {
+			os.Exit(interrupted.exitCode())
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(signals)
+		cancel(nil)
+	}
+}
+
+// interrupted returns the signal that cancelled ctx, if any.
+func interrupted(ctx context.Context) (interruptedError, bool) {
+	var e interruptedError
+	ok := errors.As(context.Cause(ctx), &e)
+	return e, ok
+}
+
+// withDeadline bounds a whole run by --deadline, if set.
+func (c *Config) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.DeadlineSeconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	deadline := time.Duration(c.DeadlineSeconds) * time.Second
+	return context.WithTimeoutCause(ctx, deadline, fmt.Errorf("--deadline of %s exceeded", deadline))
+}
+
+// sleepContext sleeps for d, or until ctx is done. It reports whether the
+// whole time was slept.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRunCancellation checks that a signal's cancellation reaches the waits
+// with its cause and maps to the shell's exit code, and that --deadline
+// bounds the run.
+func TestRunCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(interruptedError{syscall.SIGTERM})
+
+	e, ok := interrupted(ctx)
+	if !ok || e.exitCode() != 143 {
+		t.Errorf("interrupted = %v, %t; want exit code 143", e, ok)
+	}
+	if (interruptedError{syscall.SIGINT}).exitCode() != 130 {
+		t.Error("SIGINT doesn't exit with 130")
+	}
+	if _, ok := interrupted(context.Background()); ok {
+		t.Error("a live context counts as interrupted")
+	}
+
+	_, err := newPageWatch(ctx).wait(time.Minute, "the sign-in form", hasX(XPathUsername))
+	if err == nil || !strings.Contains(err.Error(), "interrupted by SIGTERM") {
+		t.Errorf("wait after SIGTERM = %v", err)
+	}
+	if sleepContext(ctx, time.Minute) {
+		t.Error("sleepContext slept through the cancellation")
+	}
+
+	limited, stop := (&Config{DeadlineSeconds: 90}).withDeadline(context.Background())
+	defer stop()
+	if deadline, ok := limited.Deadline(); !ok || time.Until(deadline) > 90*time.Second {
+		t.Errorf("--deadline 90 gives deadline %v, %t", deadline, ok)
+	}
+	unlimited, stop := (&Config{}).withDeadline(context.Background())
+	defer stop()
+	if _, ok := unlimited.Deadline(); ok {
+		t.Error("no --deadline still sets a deadline")
+	}
+}
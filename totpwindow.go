@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pquerna/otp/totp"
+)
+
+// TOTPMaxWait bounds how long a login queues for an unused TOTP window. Each
+// concurrent login ahead in the queue costs one period.
+const TOTPMaxWait = 5 * time.Minute
+
+// totpMu serializes reservations within this process; the state file lock
+// serializes them across processes.
+var totpMu sync.Mutex
+
+// totpCode generates a TOTP code that no other login has used. AWS rejects
+// a code that was already accepted, so concurrent logins sharing a secret
+// each reserve their own time step and wait for it to start. A wait cut short
+// by ctx gives the step back. now is the clock steps are reserved by.
+func totpCode(ctx context.Context, secret Secret, opts totp.ValidateOpts, now func() time.Time) (Secret, error) {
+	at, err := reserveTOTPStep(secret, opts.Period, now())
+	if err != nil {
+		log.Warn("Could not coordinate TOTP codes with other logins; using the current one", "error", err)
+		at = now()
+	}
+
+	if wait := at.Sub(now()); wait > 0 {
+		if wait > TOTPMaxWait {
+			return Secret{}, fmt.Errorf("too many concurrent logins waiting for a TOTP code (next free window in %s)", wait.Round(time.Second))
+		}
+		log.Info("Current TOTP code already used by another login; waiting for the next window", "wait", wait.Round(time.Second))
+		if !sleepContext(ctx, wait) {
+			if err := releaseTOTPStep(secret, opts.Period, at); err != nil {
+				log.Debug("Could not release the reserved TOTP window", "error", err)
+			}
+			return Secret{}, fmt.Errorf("stopped waiting for a TOTP window: %v", context.Cause(ctx))
+		}
+	}
+
+	code, err := totp.GenerateCodeCustom(secret.Reveal(), at, opts)
+	if err != nil {
+		return Secret{}, err
+	}
+	return NewSecret(code), nil
+}
+
+// reserveTOTPStep records and returns the start of the first TOTP time step at
+// or after now that wasn't reserved before. Reservations for one secret are
+// kept in a small state file under the user cache dir, named by a hash of the
+// secret and period, and holding the last reserved step.
+func reserveTOTPStep(secret Secret, period uint, now time.Time) (time.Time, error) {
+	var step int64
+	err := updateTOTPState(secret, period, func(last int64) int64 {
+		step = now.Unix() / int64(period)
+		if step <= last {
+			step = last + 1
+		}
+		return step
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(step*int64(period), 0), nil
+}
+
+// releaseTOTPStep gives back the step starting at at, if it is still the last
+// one reserved. A later reservation keeps it taken: the window is wasted.
+func releaseTOTPStep(secret Secret, period uint, at time.Time) error {
+	step := at.Unix() / int64(period)
+	return updateTOTPState(secret, period, func(last int64) int64 {
+		if last == step {
+			return step - 1
+		}
+		return last
+	})
+}
+
+// updateTOTPState replaces the last reserved step of a secret by update's
+// result, under both locks.
+func updateTOTPState(secret Secret, period uint, update func(last int64) int64) error {
+	path, err := totpStatePath(secret, period)
+	if err != nil {
+		return err
+	}
+
+	totpMu.Lock()
+	defer totpMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	defer unlockFile(f)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	last, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64) // unreadable means none
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(strconv.FormatInt(update(last), 10)+"\n"), 0)
+	return err
+}
+
+// totpStatePath names the state file for a secret. Only a hash of the
+// secret ends up on disk.
+func totpStatePath(secret Secret, period uint) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no user cache dir for TOTP state: %v", err)
+	}
+	h := sha256.New()
+	io.WriteString(h, secret.Reveal())
+	fmt.Fprintf(h, "/%d", period)
+	return filepath.Join(cache, "awsssologin", "totp", fmt.Sprintf("%x.state", h.Sum(nil)[:8])), nil
+}
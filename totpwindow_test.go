@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReserveTOTPStep checks that logins sharing a TOTP secret never get the
+// same time step, also when reserving concurrently, and that a step in the
+// past doesn't hold back a later login. A login interrupted while queueing
+// gives its step back.
+func TestReserveTOTPStep(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("LocalAppData", t.TempDir())
+
+	secret := NewSecret("JBSWY3DPEHPK3PXP")
+	defer secret.Wipe()
+	now := time.Unix(1_700_000_010, 0) // 10s into a 30s step
+
+	first, err := reserveTOTPStep(secret, 30, now)
+	if err != nil {
+		t.Fatalf("reserveTOTPStep: %v", err)
+	}
+	if want := time.Unix(1_700_000_010/30*30, 0); !first.Equal(want) {
+		t.Errorf("first reservation = %v, want the current step %v", first, want)
+	}
+	second, _ := reserveTOTPStep(secret, 30, now)
+	if second.Sub(first) != 30*time.Second {
+		t.Errorf("second reservation = %v, want the next step after %v", second, first)
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		steps = map[int64]bool{}
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			at, err := reserveTOTPStep(secret, 30, now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if steps[at.Unix()] {
+				t.Errorf("step %v reserved twice", at)
+			}
+			steps[at.Unix()] = true
+		}()
+	}
+	wg.Wait()
+
+	later := now.Add(time.Hour)
+	if at, _ := reserveTOTPStep(secret, 30, later); at.After(later) {
+		t.Errorf("reservation an hour later = %v, want the step in progress", at)
+	}
+
+	other := NewSecret("GEZDGNBVGY3TQOJQ")
+	defer other.Wipe()
+	if at, _ := reserveTOTPStep(other, 30, now); !at.Equal(first) {
+		t.Errorf("another secret's reservation = %v, want %v", at, first)
+	}
+
+	queued := NewSecret("MFRGGZDFMZTWQ2LK")
+	defer queued.Wipe()
+	current, _ := reserveTOTPStep(queued, 30, now)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts, _ := totpOpts(totpParams{})
+	if _, err := totpCode(ctx, queued, opts, func() time.Time { return now }); err == nil {
+		t.Error("totpCode waited out a cancelled context")
+	}
+	if at, _ := reserveTOTPStep(queued, 30, now); at.Sub(current) != 30*time.Second {
+		t.Errorf("reservation after a cancelled wait = %v, want the released step after %v", at, current)
+	}
+}
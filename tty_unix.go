@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// openTTY opens the controlling terminal for interactive prompts. Prompts go
+// through it rather than stdin/stdout so they keep working when stdin is the
+// upstream CLI's pipe and stdout is forwarding that CLI's output. in and out
+// are the same file, closed once by closeTTY.
+func openTTY() (in *os.File, out io.Writer, closeTTY func(), err error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return tty, tty, func() { tty.Close() }, nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// openTTY opens the console for interactive prompts. Prompts go through it
+// rather than stdin/stdout so they keep working when stdin is the upstream
+// CLI's pipe and stdout is forwarding that CLI's output. closeTTY closes both
+// console handles.
+func openTTY() (in *os.File, out io.Writer, closeTTY func(), err error) {
+	in, err = os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conout, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		in.Close()
+		return nil, nil, nil, err
+	}
+	return in, conout, func() {
+		in.Close()
+		conout.Close()
+	}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// DefaultTwoFACmdTimeout bounds a single --2fa-cmd run. It is generous
+	// because hardware tokens (e.g. YubiKey OATH) may wait for a touch.
+	DefaultTwoFACmdTimeout = 60
+	// TwoFACmdAttempts is how many times --2fa-cmd is run for one MFA field
+	// before giving up, i.e. the first run plus re-runs after a rejected code.
+	TwoFACmdAttempts = 3
+)
+
+// mfaContext describes the page an MFA code is being requested for. It is
+// passed to --2fa-cmd as environment variables so one script can serve
+// several identities or flows.
+type mfaContext struct {
+	Flow    string // "device" or "dex"
+	Host    string // host of the page showing the MFA field
+	Attempt int    // 1 for the first run, incremented on each re-run
+}
+
+// runTwoFACommand runs the --2fa-cmd hook through the platform shell and
+// returns its trimmed stdout as the 2FA code. The command's stderr is passed
+// through so it can tell the user to e.g. touch their security key. The page
+// context and username are exported as AWSSSOLOGIN_MFA_* variables.
+func runTwoFACommand(ctx context.Context, config *Config, mctx mfaContext) (string, error) {
+	timeout := time.Duration(config.TwoFACmdTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, config.TwoFACmd)
+	cmd.Env = append(os.Environ(),
+		"AWSSSOLOGIN_MFA_FLOW="+mctx.Flow,
+		"AWSSSOLOGIN_MFA_HOST="+mctx.Host,
+		"AWSSSOLOGIN_MFA_USERNAME="+config.Username,
+		fmt.Sprintf("AWSSSOLOGIN_MFA_ATTEMPT=%d", mctx.Attempt),
+	)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	log.Debug("Running 2FA command", "flow", mctx.Flow, "host", mctx.Host, "attempt", mctx.Attempt)
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("2FA command timed out after %s", timeout)
+		}
+		return "", fmt.Errorf("2FA command failed: %v", err)
+	}
+
+	code := strings.TrimSpace(stdout.String())
+	if code == "" {
+		return "", fmt.Errorf("2FA command printed no code")
+	}
+	return code, nil
+}
+
+// shellCommand runs line through the platform shell. stdout/stderr are left
+// to the caller; grandchildren still holding them after ctx kills the shell
+// are not waited on for long.
+func shellCommand(ctx context.Context, line string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", line)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", line)
+	}
+	cmd.WaitDelay = time.Second
+	return cmd
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestRunTwoFACommand checks that the hook's stdout is trimmed into the code,
+// that the page context reaches it through the environment, and that a hung
+// command is cut off by its timeout.
+func TestRunTwoFACommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test commands use POSIX sh syntax")
+	}
+
+	config := &Config{
+		Username:               "alice@example.com",
+		TwoFACmd:               `printf '  %s-%s-%s-%s\n' "$AWSSSOLOGIN_MFA_FLOW" "$AWSSSOLOGIN_MFA_HOST" "$AWSSSOLOGIN_MFA_USERNAME" "$AWSSSOLOGIN_MFA_ATTEMPT"`,
+		TwoFACmdTimeoutSeconds: 5,
+	}
+	code, err := runTwoFACommand(t.Context(), config, mfaContext{Flow: "dex", Host: "example.awsapps.com", Attempt: 2})
+	if err != nil {
+		t.Fatalf("runTwoFACommand: %v", err)
+	}
+	if want := "dex-example.awsapps.com-alice@example.com-2"; code != want {
+		t.Errorf("code = %q, want %q", code, want)
+	}
+
+	config.TwoFACmd = "true"
+	if _, err := runTwoFACommand(t.Context(), config, mfaContext{}); err == nil {
+		t.Error("expected an error for a command that prints nothing")
+	}
+
+	config.TwoFACmd = "sleep 3"
+	config.TwoFACmdTimeoutSeconds = 1
+	_, err = runTwoFACommand(t.Context(), config, mfaContext{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
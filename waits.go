@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+const (
+	// pageChangedBinding is the function the page's MutationObserver calls to
+	// report DOM changes.
+	pageChangedBinding = "awsssologinPageChanged"
+	// WatchRecheckInterval is how often a wait re-checks the page when no
+	// event arrived, as a safety net for changes no event reports.
+	WatchRecheckInterval = 2 * time.Second
+)
+
+// observerJS runs in every document of the login page and reports DOM
+// changes through pageChangedBinding, coalesced to one call per 50ms.
+const observerJS = `(() => {
+  let pending = false;
+  const changed = () => {
+    if (pending) return;
+    pending = true;
+    setTimeout(() => {
+      pending = false;
+      if (typeof window.` + pageChangedBinding + ` === 'function') window.` + pageChangedBinding + `('');
+    }, 50);
+  };
+  new MutationObserver(changed).observe(document, {childList: true, subtree: true, attributes: true});
+})()`
+
+// pageCheck reports whether something a wait is for has happened. p is the
+// page bound to the wait's context.
+type pageCheck func(p *rod.Page) (bool, error)
+
+// pageWatch lets the login's waits sleep until the page may have changed,
+// rather than poll it: it is woken by main-frame navigations
+// (Page.frameNavigated, frameRequestedNavigation, navigatedWithinDocument)
+// and by DOM mutations, and keeps track of the main frame's URL. It also
+// records the main-frame URLs that answered with a redirect, which are never
+// committed: a CLI's callback may redirect to a "you may close this window"
+// page elsewhere.
+type pageWatch struct {
+	page *rod.Page
+	ctx  context.Context // the page's; done when the login is abandoned
+
+	mu      sync.Mutex
+	url     string        // main frame's committed URL
+	passed  []string      // main-frame URLs that redirected
+	err     error         // fails every wait, e.g. a callback relay error
+	changed chan struct{} // closed and replaced on every change
+	stop    func()
+}
+
+// watchPage starts watching a blank page, before it navigates.
+func watchPage(page *rod.Page) (*pageWatch, error) {
+	w := newPageWatch(page.GetContext())
+	w.page = page
+
+	ctx, cancel := context.WithCancel(page.GetContext())
+	p := page.Context(ctx)
+	wait := p.EachEvent(func(e *proto.PageFrameNavigated) {
+		if e.Frame.ParentID == "" {
+			// An error page, e.g. once the CLI's callback server has
+			// stopped, still counts as reaching the URL it failed to load.
+			if e.Frame.UnreachableURL != "" {
+				w.navigated(e.Frame.UnreachableURL)
+			} else {
+				w.navigated(e.Frame.URL)
+			}
+		}
+	}, func(e *proto.PageNavigatedWithinDocument) {
+		if e.FrameID == page.FrameID {
+			w.navigated(e.URL)
+		}
+	}, func(e *proto.PageFrameRequestedNavigation) {
+		if e.FrameID == page.FrameID {
+			log.Debug("Page requested navigation", "url", e.URL, "reason", e.Reason)
+			w.notify()
+		}
+	}, func(e *proto.NetworkRequestWillBeSent) {
+		if e.FrameID == page.FrameID && e.Type == proto.NetworkResourceTypeDocument && e.RedirectResponse != nil {
+			w.redirected(e.RedirectResponse.URL)
+		}
+	}, func(e *proto.RuntimeBindingCalled) {
+		if e.Name == pageChangedBinding {
+			w.notify()
+		}
+	})
+	go wait()
+	w.stop = cancel
+
+	if err := (proto.NetworkEnable{}).Call(p); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to watch the page: %v", err)
+	}
+	if err := (proto.RuntimeAddBinding{Name: pageChangedBinding}).Call(p); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to watch the page: %v", err)
+	}
+	if _, err := (proto.PageAddScriptToEvaluateOnNewDocument{Source: observerJS}).Call(p); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to watch the page: %v", err)
+	}
+	return w, nil
+}
+
+func newPageWatch(ctx context.Context) *pageWatch {
+	return &pageWatch{ctx: ctx, changed: make(chan struct{}), stop: func() {}}
+}
+
+// close stops watching the page.
+func (w *pageWatch) close() {
+	w.stop()
+}
+
+// navigated records the main frame's new URL.
+func (w *pageWatch) navigated(url string) {
+	w.mu.Lock()
+	w.url = url
+	w.mu.Unlock()
+	w.notify()
+}
+
+// redirected records a main-frame URL that answered with a redirect.
+func (w *pageWatch) redirected(url string) {
+	w.mu.Lock()
+	w.passed = append(w.passed, url)
+	w.mu.Unlock()
+	w.notify()
+}
+
+// fail makes the waits fail with err, e.g. when the callback couldn't be
+// relayed: the page would only show a browser error.
+func (w *pageWatch) fail(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+	w.notify()
+}
+
+// notify wakes the waits.
+func (w *pageWatch) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// changes returns a channel closed on the next change.
+func (w *pageWatch) changes() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+// URL returns the main frame's URL as of its last navigation.
+func (w *pageWatch) URL() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.url
+}
+
+// passedThrough returns the URL passing match that the main frame is at or
+// has been through, committed or redirected on the way.
+func (w *pageWatch) passedThrough(match func(rawURL string) bool) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if match(w.url) {
+		return w.url, true
+	}
+	for _, u := range w.passed {
+		if match(u) {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// wait checks, whenever the page changes and until the timeout, for the
+// first of checks to pass, and returns its index. A timeout reports what was
+// waited for.
+func (w *pageWatch) wait(timeout time.Duration, what string, checks ...pageCheck) (int, error) {
+	ctx, cancel := context.WithTimeout(w.ctx, timeout)
+	defer cancel()
+	var p *rod.Page
+	if w.page != nil {
+		p = w.page.Context(ctx)
+	}
+	recheck := time.NewTicker(WatchRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		// Taken before checking, so a change during the checks isn't missed.
+		changed := w.changes()
+		w.mu.Lock()
+		err := w.err
+		w.mu.Unlock()
+		if err != nil {
+			return -1, err
+		}
+		for i, check := range checks {
+			if ctx.Err() != nil {
+				break // a check failing on the ended context would hide why
+			}
+			ok, err := check(p)
+			if ctx.Err() != nil {
+				break
+			}
+			if err != nil {
+				return -1, err
+			}
+			if ok {
+				return i, nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && w.ctx.Err() == nil {
+				return -1, fmt.Errorf("timed out after %s waiting for %s", timeout, what)
+			}
+			return -1, fmt.Errorf("stopped waiting for %s: %v", what, context.Cause(ctx))
+		}
+	}
+}
+
+// element waits for an element to appear. The element keeps what is left of
+// the timeout for the actions on it.
+func (w *pageWatch) element(xpath, description string, timeout time.Duration) (*rod.Element, error) {
+	deadline := time.Now().Add(timeout)
+	var el *rod.Element
+	_, err := w.wait(timeout, description, func(p *rod.Page) (bool, error) {
+		has, e, err := p.HasX(xpath)
+		el = e
+		return has, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The element was found under the wait's context, which ends here.
+	return el.Context(w.ctx).Timeout(time.Until(deadline)), nil
+}
+
+// hasX passes once an element matches xpath.
+func hasX(xpath string) pageCheck {
+	return func(p *rod.Page) (bool, error) {
+		has, _, err := p.HasX(xpath)
+		if err != nil {
+			return false, fmt.Errorf("failed to probe for %s: %v", xpath, err)
+		}
+		return has, nil
+	}
+}
+
+// lacksX passes once no element matches xpath.
+func lacksX(xpath string) pageCheck {
+	has := hasX(xpath)
+	return func(p *rod.Page) (bool, error) {
+		ok, err := has(p)
+		return !ok, err
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPageWatch checks that a wait wakes on a navigation rather than on its
+// recheck interval, reports which check passed, and names what it waited for
+// when it times out.
+func TestPageWatch(t *testing.T) {
+	w := newPageWatch(context.Background())
+	w.navigated("https://corp.awsapps.com/start")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.navigated("http://localhost:8085/auth/callback?code=x")
+	}()
+	start := time.Now()
+	never := oidcCallback{origin: "https://never", path: "/"}
+	callback := oidcCallback{origin: "http://localhost:8085", path: "/auth/callback"}
+	first, err := w.wait(time.Minute, "the callback", w.atCallback(never), w.atCallback(callback))
+	if err != nil || first != 1 {
+		t.Fatalf("wait = %d, %v; want 1", first, err)
+	}
+	if took := time.Since(start); took >= WatchRecheckInterval {
+		t.Errorf("wait took %s, want it woken by the navigation", took)
+	}
+
+	closed := oidcCallback{origin: "http://127.0.0.1:9", path: "/"}
+	_, err = w.wait(50*time.Millisecond, "redirect to http://127.0.0.1:9", w.atCallback(closed))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 50ms waiting for redirect to http://127.0.0.1:9") {
+		t.Errorf("timeout error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newPageWatch(ctx).wait(time.Minute, "anything", w.atCallback(never)); err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("wait on an abandoned page = %v, want it stopped", err)
+	}
+}